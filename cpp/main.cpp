@@ -24,7 +24,8 @@ int main() {
 
     NetworkClient signal_client(
         config.get<std::string>("Networking.signal_ip"),
-        config.get<int>("Networking.signal_port")
+        config.get<int>("Networking.signal_port"),
+        std::to_string(config.get<int>("Tracker.camera_id"))
     );
     signal_client.startStreaming();
 
@@ -1,7 +1,7 @@
 #include "network_client.h"
 #include <thread>
 
-NetworkClient::NetworkClient(std::string ip, int port) {
+NetworkClient::NetworkClient(std::string ip, int port, std::string camera_id) : camera_id_(camera_id) {
     // 1. Create a Channel to the Go server (using insecure credentials for local setup)
     std::string target_address = ip + ":" + std::to_string(port);
     channel_ = grpc::CreateChannel(target_address, grpc::InsecureChannelCredentials());
@@ -39,6 +39,7 @@ bool NetworkClient::startStreaming() {
         context_ = nullptr;
     }
     context_ = std::make_shared<grpc::ClientContext>();
+    context_->AddMetadata("camera-id", camera_id_);
 
     // Initiate the streaming RPC call:
     // The stub creates the ClientWriter object, linking the context and the final response object.
@@ -8,7 +8,7 @@
 
 class NetworkClient {
 public:
-    NetworkClient(std::string ip, int port);
+    NetworkClient(std::string ip, int port, std::string camera_id);
     ~NetworkClient();
 
     bool startStreaming();
@@ -31,6 +31,9 @@ private:
 
     // The object that will hold the final response from the Go server.
     tracker::StreamStatus status_response_;
+
+    // Sent as "camera-id" metadata so the server can name recordings by camera.
+    std::string camera_id_;
 };
 
 #endif // NETWORKCLIENT_H
@@ -0,0 +1,225 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"yolo-detector-service/bootstrap"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultLayout          = "{camera}/{yyyy}/{mm}/{dd}/{start}_{classes}{ext}"
+	DefaultTimelapseLayout = "{camera}/timelapse/{yyyy}/{mm}/{dd}/{start}{ext}"
+	DefaultDvrLayout       = "{camera}/dvr/{yyyy}/{mm}/{dd}/{start}{ext}"
+)
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Entry describes one finished segment waiting in RECORDINGS_TMP_DIR
+type Entry struct {
+	Camera  string
+	Session int
+	Event   string
+	Segment int
+	Start   time.Time
+	Classes []string
+	Path    string
+}
+
+// Target is where the segment goes in ARCHIVE_DIR following ARCHIVE_LAYOUT,
+// without ARCHIVE_DIR the file stays where it is
+func Target(env *bootstrap.Env, entry Entry) (string, error) {
+	layout := env.ARCHIVE_LAYOUT
+	if layout == "" {
+		layout = DefaultLayout
+	}
+	return TargetIn(env, entry, layout)
+}
+
+// TargetIn is Target with a layout of its own, e.g. TIMELAPSE_LAYOUT
+func TargetIn(env *bootstrap.Env, entry Entry, layout string) (string, error) {
+	if env.ARCHIVE_DIR == "" {
+		return entry.Path, nil
+	}
+	return freePath(filepath.Join(env.ARCHIVE_DIR, entry.Expand(layout)))
+}
+
+// Finalize moves the segment to target, the file appears there complete or not at all,
+// with a key it is encrypted to StoredPath(target) and the plain file is removed.
+// The reservation of the name by Target is given up either way
+func Finalize(entry Entry, target string, key *Key) error {
+	// the clip holds the name from now on, or it is free again
+	defer release(target)
+	if key != nil {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to create archive directory: %w", err)
+		}
+		if err := EncryptFile(entry.Path, StoredPath(target, key), key); err != nil {
+			return fmt.Errorf("failed to encrypt: %w", err)
+		}
+		return os.Remove(entry.Path)
+	}
+	if target == entry.Path {
+		return nil
+	}
+	return MoveFile(entry.Path, target)
+}
+
+// Expand fills the layout placeholders
+// {camera} {session} {event} {segment} {yyyy} {mm} {dd} {hh} {start} {classes} {ext}
+func (e Entry) Expand(layout string) string {
+	start := e.Start.Local()
+	classes := make([]string, 0, len(e.Classes))
+	for _, name := range e.Classes {
+		classes = append(classes, sanitize(name))
+	}
+	if len(classes) == 0 {
+		classes = append(classes, "none")
+	}
+	replacer := strings.NewReplacer(
+		"{camera}", sanitize(e.Camera),
+		"{session}", fmt.Sprintf("%04d", e.Session),
+		"{event}", sanitize(e.Event),
+		"{segment}", fmt.Sprintf("%02d", e.Segment),
+		"{yyyy}", start.Format("2006"),
+		"{mm}", start.Format("01"),
+		"{dd}", start.Format("02"),
+		"{hh}", start.Format("15"),
+		"{start}", start.Format("20060102T150405"),
+		"{classes}", strings.Join(classes, "-"),
+		"{ext}", filepath.Ext(e.Path),
+	)
+	return filepath.FromSlash(replacer.Replace(layout))
+}
+
+func sanitize(value string) string {
+	value = unsafeChars.ReplaceAllString(strings.TrimSpace(value), "_")
+	if value == "" || value == "." || value == ".." {
+		return "unknown"
+	}
+	return value
+}
+
+// freePath adds a counter to the name if the path or its sidecar is taken,
+// the name is reserved by a hidden file next to it that Finalize removes,
+// so segments finalized at the same time never get the same one and
+// nothing shows up under the name before the clip is complete
+func freePath(path string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	candidate := path
+	for i := 1; ; i++ {
+		taken, err := nameTaken(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			file, err := os.OpenFile(reservation(candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+			if err == nil {
+				file.Close()
+				// a clip finalized meanwhile is in place before its reservation goes
+				taken, err = nameTaken(candidate)
+				if err == nil && !taken {
+					return candidate, nil
+				}
+				release(candidate)
+				if err != nil {
+					return "", err
+				}
+			} else if !errors.Is(err, os.ErrExist) {
+				return "", err
+			}
+		}
+		candidate = base + "_" + strconv.Itoa(i) + ext
+	}
+}
+
+// nameTaken tells if a clip or its sidecar is stored under the name
+func nameTaken(path string) (bool, error) {
+	taken, err := exists(path)
+	if err == nil && !taken {
+		taken, err = exists(SidecarPath(path))
+	}
+	return taken, err
+}
+
+// reservation is the hidden file holding the name of a clip being finalized
+func reservation(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".reserve")
+}
+
+// exists tells if the path is taken, stored plain or encrypted
+func exists(path string) (bool, error) {
+	for _, name := range []string{path, path + EncryptedExt} {
+		_, err := os.Stat(name)
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// release gives up the reservation of a name
+func release(target string) {
+	if err := os.Remove(reservation(target)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.Warnf("Failed to remove the reservation of %s: %v", target, err)
+	}
+}
+
+// MoveFile renames src to dst, across filesystems it copies into a hidden
+// file next to dst first so dst is never seen half written
+func MoveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
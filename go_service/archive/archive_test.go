@@ -0,0 +1,108 @@
+package archive
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestFreePathReservesDistinctNames(t *testing.T) {
+	dir := t.TempDir()
+	names := make([]string, 20)
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name, err := freePath(filepath.Join(dir, "cam", "clip.mkv"))
+			if err != nil {
+				t.Error(err)
+			}
+			names[i] = name
+		}(i)
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			t.Fatalf("%s handed out twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+func TestFreePathSkipsEncryptedAndSidecar(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"clip.mkv.enc", "clip_1.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name, err := freePath(filepath.Join(dir, "clip.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "clip_2.mkv"); name != want {
+		t.Fatalf("got %s, want %s", name, want)
+	}
+}
+
+func TestFreePathReservesHidden(t *testing.T) {
+	dir := t.TempDir()
+	target, err := freePath(filepath.Join(dir, "clip.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(target); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("%s visible before the clip is finalized: %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".clip.mkv.reserve")); err != nil {
+		t.Fatalf("no reservation: %v", err)
+	}
+}
+
+func TestFinalizeReleasesReservation(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		dir := t.TempDir()
+		var key *Key
+		if encrypted {
+			key = testKey
+		}
+		src := filepath.Join(dir, "segment.mkv")
+		if err := os.WriteFile(src, []byte("frames"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		target, err := freePath(filepath.Join(dir, "archive", "clip.mkv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Finalize(Entry{Path: src}, target, key); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ReadFile(StoredPath(target, key), key)
+		if err != nil || string(data) != "frames" {
+			t.Fatalf("encrypted %v: got %q, %v", encrypted, data, err)
+		}
+		if encrypted {
+			if _, err := os.Stat(target); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("plain %s stored next to the encrypted clip: %v", target, err)
+			}
+		}
+		if _, err := os.Stat(reservation(target)); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("reservation of %s left behind: %v", target, err)
+		}
+		if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("source %s left behind: %v", src, err)
+		}
+		// the name stays taken by the clip
+		next, err := freePath(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == target {
+			t.Fatalf("encrypted %v: %s handed out again", encrypted, target)
+		}
+	}
+}
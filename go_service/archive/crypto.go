@@ -0,0 +1,338 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EncryptedExt is appended to the name of every file stored encrypted
+const EncryptedExt = ".enc"
+
+// Encrypted files are a header of the magic and a random nonce prefix,
+// followed by chunks sealed with AES-256-GCM. The nonce of a chunk is the
+// prefix, the chunk counter and a flag set on the last chunk, so reordered,
+// dropped or truncated chunks fail to open.
+const (
+	encryptedMagic = "YDE1"
+	noncePrefixLen = 7
+	headerLen      = len(encryptedMagic) + noncePrefixLen
+	chunkSize      = 64 << 10
+	tagSize        = 16
+)
+
+var (
+	ErrNotEncrypted = errors.New("not an encrypted recording")
+	ErrDecrypt      = errors.New("decryption failed, wrong key or damaged file")
+)
+
+type Key [32]byte
+
+// LoadKey reads a key file holding 32 bytes, raw or as 64 hex characters,
+// e.g. made with: openssl rand -hex 32
+func LoadKey(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var key Key
+	if text := strings.TrimSpace(string(data)); len(text) == 2*len(key) {
+		if _, err := hex.Decode(key[:], []byte(text)); err == nil {
+			return &key, nil
+		}
+	}
+	if len(data) != len(key) {
+		return nil, fmt.Errorf("key file %s holds neither 32 bytes nor 64 hex characters", path)
+	}
+	copy(key[:], data)
+	return &key, nil
+}
+
+func (k *Key) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixLen:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewEncryptWriter encrypts everything written to it into dst,
+// Close seals the last chunk and must not be skipped
+func NewEncryptWriter(dst io.Writer, key *Key) (io.WriteCloser, error) {
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixLen)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		dst:    dst,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			// only sealed now that more data follows, the last chunk is sealed by Close
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("file too large to encrypt")
+	}
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.counter, last), w.buf, nil)
+	w.counter += 1
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+// NewDecryptReader returns the plaintext of an encrypted stream, every chunk
+// is authenticated before it is returned, a damaged file ends with ErrDecrypt
+func NewDecryptReader(src io.Reader, key *Key) (io.Reader, error) {
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrNotEncrypted
+	}
+	return &decryptReader{
+		src:    bufio.NewReaderSize(src, chunkSize+tagSize),
+		aead:   aead,
+		prefix: header[len(encryptedMagic):],
+		buf:    make([]byte, chunkSize+tagSize),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decryptReader) open() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return err
+	}
+	last := n < len(r.buf)
+	if !last {
+		if _, err := r.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		}
+	}
+	plain, err := r.aead.Open(r.buf[:0], chunkNonce(r.prefix, r.counter, last), r.buf[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.counter += 1
+	r.plain = plain
+	r.done = last
+	return nil
+}
+
+// DecryptedSize is the plaintext size of an encrypted file of the given size
+func DecryptedSize(size int64) int64 {
+	body := size - int64(headerLen)
+	if body < tagSize {
+		return 0
+	}
+	chunks := (body + chunkSize + tagSize - 1) / (chunkSize + tagSize)
+	return body - chunks*tagSize
+}
+
+// IsEncrypted tells by the name if a stored file is encrypted
+func IsEncrypted(path string) bool {
+	return strings.HasSuffix(path, EncryptedExt)
+}
+
+// StoredPath is the name a file gets on disk, with a key it is encrypted
+func StoredPath(path string, key *Key) string {
+	if key == nil {
+		return path
+	}
+	return path + EncryptedExt
+}
+
+// WriteFile stores data at path, encrypted to StoredPath when a key is given,
+// readers never see it half written
+func WriteFile(path string, data []byte, key *Key) (string, error) {
+	stored := StoredPath(path, key)
+	if key == nil {
+		return stored, WriteFileAtomic(stored, data)
+	}
+	return stored, writeEncrypted(stored, bytes.NewReader(data), key)
+}
+
+// EncryptFile stores src encrypted at dst
+func EncryptFile(src string, dst string, key *Key) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeEncrypted(dst, in, key)
+}
+
+// DecryptFile writes the plaintext of src to dst
+func DecryptFile(src string, dst string, key *Key) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	plain, err := NewDecryptReader(in, key)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+	if err := copyInto(tmp, plain); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ReadFile returns the content of a stored file, decrypted if its name says so
+func ReadFile(path string, key *Key) ([]byte, error) {
+	if !IsEncrypted(path) {
+		return os.ReadFile(path)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%s is encrypted and no key is configured", path)
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	plain, err := NewDecryptReader(in, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plain)
+}
+
+func writeEncrypted(dst string, src io.Reader, key *Key) error {
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+	err := func() error {
+		out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		sealed, err := NewEncryptWriter(out, key)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(sealed, src); err != nil {
+			return err
+		}
+		if err := sealed.Close(); err != nil {
+			return err
+		}
+		if err := out.Sync(); err != nil {
+			return err
+		}
+		return out.Close()
+	}()
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func copyInto(path string, src io.Reader) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
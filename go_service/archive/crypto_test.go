@@ -0,0 +1,106 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+var testKey = &Key{1, 2, 3}
+
+func encrypt(t *testing.T, plain []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewEncryptWriter(&sealed, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// written in odd pieces so chunks are filled across writes
+	for data := plain; len(data) > 0; {
+		n := min(len(data), 1000)
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func decrypt(sealed []byte, key *Key) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encrypt(t, plain)
+		if got := DecryptedSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: DecryptedSize is %d", size, got)
+		}
+		got, err := decrypt(sealed, testKey)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: plaintext differs", size)
+		}
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	plain := make([]byte, 2*chunkSize+100)
+	rand.Read(plain)
+	sealed := encrypt(t, plain)
+	firstChunk := headerLen + chunkSize + tagSize
+
+	swapped := append([]byte{}, sealed[:headerLen]...)
+	swapped = append(swapped, sealed[firstChunk:2*firstChunk-headerLen]...)
+	swapped = append(swapped, sealed[headerLen:firstChunk]...)
+	swapped = append(swapped, sealed[2*firstChunk-headerLen:]...)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		key    *Key
+	}{
+		{"flipped bit", flip(sealed, headerLen+10), testKey},
+		{"flipped tag", flip(sealed, len(sealed)-1), testKey},
+		{"flipped nonce prefix", flip(sealed, len(encryptedMagic)), testKey},
+		{"reordered chunks", swapped, testKey},
+		{"wrong key", sealed, &Key{3, 2, 1}},
+		{"truncated at a chunk boundary", sealed[:firstChunk], testKey},
+		{"truncated inside a chunk", sealed[:firstChunk+50], testKey},
+		{"truncated last chunk", sealed[:len(sealed)-1], testKey},
+		{"header only", sealed[:headerLen], testKey},
+		{"appended data", append(append([]byte{}, sealed...), 0), testKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decrypt(test.sealed, test.key); !errors.Is(err, ErrDecrypt) {
+				t.Fatalf("got %v, want ErrDecrypt", err)
+			}
+		})
+	}
+}
+
+func TestDecryptRejectsPlainFile(t *testing.T) {
+	if _, err := decrypt([]byte("plain recording data"), testKey); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("got %v, want ErrNotEncrypted", err)
+	}
+}
+
+func flip(data []byte, at int) []byte {
+	flipped := append([]byte{}, data...)
+	flipped[at] ^= 1
+	return flipped
+}
@@ -0,0 +1,383 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"yolo-detector-service/bootstrap"
+)
+
+const (
+	ManifestAdd    = "add"
+	ManifestRemove = "remove"
+
+	manifestExt = ".jsonl"
+)
+
+// Manifest is a hash chain per camera of every archived file, each entry
+// carries the hash of the one before, so a changed, removed or reordered
+// entry breaks the chain and a changed file no longer matches its entry
+type Manifest struct {
+	root  string
+	dir   string
+	lock  sync.Mutex
+	heads map[string]manifestHead
+}
+
+type manifestHead struct {
+	seq  int64
+	hash string
+}
+
+// ManifestEntry is one line of a camera manifest
+type ManifestEntry struct {
+	Seq    int64          `json:"seq"`
+	Time   time.Time      `json:"time"`
+	Action string         `json:"action"`
+	Camera string         `json:"camera"`
+	Files  []ManifestFile `json:"files"`
+	Prev   string         `json:"prev"`
+	Hash   string         `json:"hash,omitempty"`
+}
+
+type ManifestFile struct {
+	// relative to the archive root
+	Path   string `json:"path"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// VerifyReport lists what did not match, no problems means the archive is intact
+type VerifyReport struct {
+	Cameras  int             `json:"cameras"`
+	Entries  int             `json:"entries"`
+	Files    int             `json:"files"`
+	Problems []VerifyProblem `json:"problems"`
+}
+
+type VerifyProblem struct {
+	Camera string `json:"camera"`
+	Seq    int64  `json:"seq,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Issue  string `json:"issue"`
+}
+
+// NewManifest keeps the manifests in MANIFEST_DIR, by default
+// .manifest below ARCHIVE_DIR or RECORDINGS_TMP_DIR
+func NewManifest(env *bootstrap.Env) *Manifest {
+	root := env.ARCHIVE_DIR
+	if root == "" {
+		root = env.RECORDINGS_TMP_DIR
+	}
+	dir := env.MANIFEST_DIR
+	if dir == "" {
+		dir = filepath.Join(root, ".manifest")
+	}
+	return &Manifest{
+		root:  filepath.Clean(root),
+		dir:   dir,
+		heads: make(map[string]manifestHead),
+	}
+}
+
+// Add appends the stored files of a finalized recording to the chain of camera
+func (m *Manifest) Add(camera string, paths []string) error {
+	if m == nil {
+		return nil
+	}
+	files := make([]ManifestFile, 0, len(paths))
+	for _, path := range paths {
+		sum, err := HashFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", path, err)
+		}
+		files = append(files, ManifestFile{Path: m.relative(path), Sha256: sum})
+	}
+	return m.append(camera, ManifestAdd, files)
+}
+
+// Remove notes in the chain of camera that files were deleted on purpose, e.g. by retention
+func (m *Manifest) Remove(camera string, paths []string) error {
+	if m == nil {
+		return nil
+	}
+	files := make([]ManifestFile, 0, len(paths))
+	for _, path := range paths {
+		files = append(files, ManifestFile{Path: m.relative(path)})
+	}
+	return m.append(camera, ManifestRemove, files)
+}
+
+func (m *Manifest) append(camera string, action string, files []ManifestFile) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	path := m.path(camera)
+	head, ok := m.heads[camera]
+	if !ok {
+		last, err := lastEntry(path)
+		if err != nil {
+			return fmt.Errorf("failed to read manifest %s: %w", path, err)
+		}
+		if last != nil {
+			head = manifestHead{seq: last.Seq, hash: last.Hash}
+		}
+	}
+	entry := &ManifestEntry{
+		Seq:    head.seq + 1,
+		Time:   time.Now().UTC(),
+		Action: action,
+		Camera: camera,
+		Files:  files,
+		Prev:   head.hash,
+	}
+	hash, err := entry.chainHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	m.heads[camera] = manifestHead{seq: entry.Seq, hash: entry.Hash}
+	return nil
+}
+
+// Live is the set of files added to any chain and not removed since,
+// by their paths on disk
+func (m *Manifest) Live() (map[string]bool, error) {
+	live := make(map[string]bool)
+	if m == nil {
+		return live, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(m.dir, "*"+manifestExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		m.lock.Lock()
+		data, err := os.ReadFile(path)
+		m.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64<<10), 16<<20)
+		for scanner.Scan() {
+			var entry ManifestEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				// blank or broken lines are left to Verify
+				continue
+			}
+			for _, f := range entry.Files {
+				switch entry.Action {
+				case ManifestAdd:
+					live[m.absolute(f.Path)] = true
+				case ManifestRemove:
+					delete(live, m.absolute(f.Path))
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+// Verify checks the chains and the files still in the archive,
+// camera limits it to one manifest, empty checks all of them
+func (m *Manifest) Verify(camera string) (*VerifyReport, error) {
+	report := &VerifyReport{Problems: []VerifyProblem{}}
+	var paths []string
+	if camera != "" {
+		paths = []string{m.path(camera)}
+	} else {
+		found, err := filepath.Glob(filepath.Join(m.dir, "*"+manifestExt))
+		if err != nil {
+			return nil, err
+		}
+		paths = found
+	}
+	for _, path := range paths {
+		if err := m.verifyChain(path, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func (m *Manifest) verifyChain(path string, report *VerifyReport) error {
+	camera := strings.TrimSuffix(filepath.Base(path), manifestExt)
+	// a snapshot, files are hashed without holding up appends
+	m.lock.Lock()
+	data, err := os.ReadFile(path)
+	m.lock.Unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			report.Problems = append(report.Problems, VerifyProblem{Camera: camera, Issue: "no manifest"})
+			return nil
+		}
+		return err
+	}
+	report.Cameras += 1
+
+	problem := func(seq int64, path string, issue string) {
+		report.Problems = append(report.Problems, VerifyProblem{Camera: camera, Seq: seq, Path: path, Issue: issue})
+	}
+	// files added and not removed since, with the entry that added them
+	live := make(map[string]ManifestFile)
+	liveSeq := make(map[string]int64)
+	var prev ManifestEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			problem(0, "", fmt.Sprintf("line %d is not a manifest entry", line))
+			continue
+		}
+		report.Entries += 1
+		if hash, err := entry.chainHash(); err != nil || hash != entry.Hash {
+			problem(entry.Seq, "", "entry hash does not match its content")
+		}
+		if entry.Seq != prev.Seq+1 {
+			problem(entry.Seq, "", fmt.Sprintf("sequence jumps from %d to %d", prev.Seq, entry.Seq))
+		}
+		if entry.Prev != prev.Hash {
+			problem(entry.Seq, "", "chain link does not match the previous entry")
+		}
+		for _, f := range entry.Files {
+			switch entry.Action {
+			case ManifestAdd:
+				live[f.Path] = f
+				liveSeq[f.Path] = entry.Seq
+			case ManifestRemove:
+				delete(live, f.Path)
+				delete(liveSeq, f.Path)
+			}
+		}
+		prev = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(live))
+	for path := range live {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		report.Files += 1
+		sum, err := HashFile(m.absolute(path))
+		if errors.Is(err, os.ErrNotExist) {
+			problem(liveSeq[path], path, "file is missing")
+			continue
+		}
+		if err != nil {
+			problem(liveSeq[path], path, err.Error())
+			continue
+		}
+		if sum != live[path].Sha256 {
+			problem(liveSeq[path], path, "file hash does not match")
+		}
+	}
+	return nil
+}
+
+// chainHash covers the entry without its own hash, the previous hash included
+func (e *ManifestEntry) chainHash() (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (m *Manifest) path(camera string) string {
+	return filepath.Join(m.dir, sanitize(camera)+manifestExt)
+}
+
+func (m *Manifest) relative(path string) string {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.ToSlash(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (m *Manifest) absolute(path string) string {
+	if filepath.IsAbs(filepath.FromSlash(path)) {
+		return filepath.FromSlash(path)
+	}
+	return filepath.Join(m.root, filepath.FromSlash(path))
+}
+
+func lastEntry(path string) (*ManifestEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	last := lines[len(lines)-1]
+	if len(last) == 0 {
+		return nil, nil
+	}
+	var entry ManifestEntry
+	if err := json.Unmarshal(last, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// HashFile is the hex SHA-256 of the file as stored
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
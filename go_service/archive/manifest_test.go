@@ -0,0 +1,150 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"yolo-detector-service/bootstrap"
+)
+
+// newTestManifest archives three recordings of camera "cam", one entry each
+func newTestManifest(t *testing.T) (*Manifest, []string) {
+	t.Helper()
+	dir := t.TempDir()
+	manifest := NewManifest(&bootstrap.Env{ARCHIVE_DIR: dir})
+	var files []string
+	for _, name := range []string{"a.mkv", "b.mkv", "c.mkv"} {
+		path := filepath.Join(dir, "cam", name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := manifest.Add("cam", []string{path}); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	return manifest, files
+}
+
+// editLines rewrites the manifest of camera "cam" line by line
+func editLines(t *testing.T, manifest *Manifest, edit func(lines [][]byte) [][]byte) {
+	t.Helper()
+	path := manifest.path("cam")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := edit(bytes.Split(bytes.TrimSpace(data), []byte("\n")))
+	if err := os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		// breaks the archive, nil leaves it intact
+		tamper func(t *testing.T, manifest *Manifest, files []string)
+		// issues expected in the report, in order
+		issues []string
+	}{
+		{
+			name:   "intact",
+			issues: nil,
+		},
+		{
+			name: "removed on purpose",
+			tamper: func(t *testing.T, manifest *Manifest, files []string) {
+				os.Remove(files[1])
+				if err := manifest.Remove("cam", files[1:2]); err != nil {
+					t.Fatal(err)
+				}
+			},
+			issues: nil,
+		},
+		{
+			name: "edited line",
+			tamper: func(t *testing.T, manifest *Manifest, files []string) {
+				editLines(t, manifest, func(lines [][]byte) [][]byte {
+					lines[1] = bytes.Replace(lines[1], []byte("b.mkv"), []byte("x.mkv"), 1)
+					return lines
+				})
+			},
+			issues: []string{"entry hash does not match its content", "file is missing"},
+		},
+		{
+			name: "deleted line",
+			tamper: func(t *testing.T, manifest *Manifest, files []string) {
+				editLines(t, manifest, func(lines [][]byte) [][]byte {
+					return slices.Delete(lines, 1, 2)
+				})
+			},
+			issues: []string{"sequence jumps from 1 to 3", "chain link does not match the previous entry"},
+		},
+		{
+			name: "reordered lines",
+			tamper: func(t *testing.T, manifest *Manifest, files []string) {
+				editLines(t, manifest, func(lines [][]byte) [][]byte {
+					lines[1], lines[2] = lines[2], lines[1]
+					return lines
+				})
+			},
+			issues: []string{
+				"sequence jumps from 1 to 3", "chain link does not match the previous entry",
+				"sequence jumps from 3 to 2", "chain link does not match the previous entry",
+			},
+		},
+		{
+			name: "modified file",
+			tamper: func(t *testing.T, manifest *Manifest, files []string) {
+				if err := os.WriteFile(files[2], []byte("changed"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			issues: []string{"file hash does not match"},
+		},
+		{
+			name: "deleted file",
+			tamper: func(t *testing.T, manifest *Manifest, files []string) {
+				os.Remove(files[0])
+			},
+			issues: []string{"file is missing"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest, files := newTestManifest(t)
+			if test.tamper != nil {
+				test.tamper(t, manifest, files)
+			}
+			report, err := manifest.Verify("cam")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var issues []string
+			for _, problem := range report.Problems {
+				issues = append(issues, problem.Issue)
+			}
+			if !slices.Equal(issues, test.issues) {
+				t.Fatalf("got issues [%s], want [%s]", strings.Join(issues, "; "), strings.Join(test.issues, "; "))
+			}
+		})
+	}
+}
+
+func TestManifestVerifyMissingManifest(t *testing.T) {
+	manifest := NewManifest(&bootstrap.Env{ARCHIVE_DIR: t.TempDir()})
+	report, err := manifest.Verify("cam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Issue != "no manifest" {
+		t.Fatalf("got %+v, want no manifest", report.Problems)
+	}
+}
@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"yolo-detector-service/bootstrap"
+)
+
+const (
+	MarkerStart = "start"
+	MarkerEnd   = "end"
+
+	markerDayFormat = "2006-01-02"
+)
+
+// Marker is where an event starts or ends in the continuous recording of a DVR session
+type Marker struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Camera    string    `json:"camera"`
+	SessionId int       `json:"session_id"`
+	Event     string    `json:"event"`
+	Class     string    `json:"class"`
+}
+
+// MarkerIndex keeps the markers of every camera as <camera>/<yyyy-mm-dd>.jsonl,
+// one file per day so the DVR window drops whole days
+type MarkerIndex struct {
+	dir  string
+	lock sync.Mutex
+}
+
+// NewMarkerIndex keeps the index in DVR_INDEX_DIR, by default
+// .dvr below ARCHIVE_DIR or RECORDINGS_TMP_DIR
+func NewMarkerIndex(env *bootstrap.Env) *MarkerIndex {
+	dir := env.DVR_INDEX_DIR
+	if dir == "" {
+		root := env.ARCHIVE_DIR
+		if root == "" {
+			root = env.RECORDINGS_TMP_DIR
+		}
+		dir = filepath.Join(root, ".dvr")
+	}
+	return &MarkerIndex{dir: dir}
+}
+
+// Append adds the marker to the day of its time
+func (x *MarkerIndex) Append(marker Marker) error {
+	if x == nil {
+		return nil
+	}
+	line, err := json.Marshal(&marker)
+	if err != nil {
+		return err
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	dir := filepath.Join(x.dir, sanitize(marker.Camera))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, marker.Time.Local().Format(markerDayFormat)+manifestExt)
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Prune deletes the days that ended before cutoff, it returns how many
+func (x *MarkerIndex) Prune(cutoff time.Time) (int, error) {
+	if x == nil {
+		return 0, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(x.dir, "*", "*"+manifestExt))
+	if err != nil {
+		return 0, err
+	}
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	pruned := 0
+	for _, path := range paths {
+		day, err := time.ParseInLocation(markerDayFormat,
+			strings.TrimSuffix(filepath.Base(path), manifestExt), time.Local)
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		if !day.AddDate(0, 0, 1).Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return pruned, fmt.Errorf("failed to prune %s: %w", path, err)
+		}
+		pruned += 1
+		// gone once its last day is
+		os.Remove(filepath.Dir(path))
+	}
+	return pruned, nil
+}
@@ -0,0 +1,109 @@
+package archive
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	pb "yolo-detector-service/grpc/generated"
+)
+
+// Sidecar is stored next to every recording as <name>.json,
+// it tells why the clip exists and what was seen in it
+type Sidecar struct {
+	SessionId    int          `json:"session_id"`
+	Peer         string       `json:"peer"`
+	Camera       string       `json:"camera"`
+	Event        string       `json:"event"`
+	Segment      int          `json:"segment"`
+	Mode         string       `json:"mode,omitempty"`
+	File         string       `json:"file"`
+	Thumbnail    string       `json:"thumbnail,omitempty"`
+	Subtitles    []string     `json:"subtitles,omitempty"`
+	Backend      string       `json:"backend"`
+	StartedAt    time.Time    `json:"started_at"`
+	EndedAt      time.Time    `json:"ended_at"`
+	Frames       int          `json:"frames"`
+	Truncated    bool         `json:"truncated"`
+	TriggerClass string       `json:"trigger_class"`
+	Classes      []string     `json:"classes"`
+	Events       []TrackEvent `json:"events"`
+}
+
+type TrackEvent struct {
+	TrackerId   int32   `json:"tracker_id"`
+	ClassName   string  `json:"class_name"`
+	ClassId     int32   `json:"class_id"`
+	Confidence  float32 `json:"confidence"`
+	Box         Box     `json:"box"`
+	TimestampMs int64   `json:"timestamp_ms"`
+}
+
+type Box struct {
+	X      int32 `json:"x"`
+	Y      int32 `json:"y"`
+	Width  int32 `json:"width"`
+	Height int32 `json:"height"`
+}
+
+// NewTrackEvent copies a detector event, frameTime is used
+// when the event came without its own timestamp
+func NewTrackEvent(event *pb.TrackEvent, frameTime time.Time) TrackEvent {
+	timestamp := event.GetTimestampMs()
+	if timestamp == 0 {
+		timestamp = frameTime.UnixMilli()
+	}
+	box := event.GetBox()
+	return TrackEvent{
+		TrackerId:   event.GetTrackerId(),
+		ClassName:   event.GetClassName(),
+		ClassId:     event.GetClassId(),
+		Confidence:  event.GetConfidence(),
+		Box:         Box{X: box.GetX(), Y: box.GetY(), Width: box.GetWidth(), Height: box.GetHeight()},
+		TimestampMs: timestamp,
+	}
+}
+
+// SidecarPath is the json next to a recording
+func SidecarPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".json"
+}
+
+// WriteSidecar stores the sidecar of recordingPath, readers never see it half written,
+// with a key the sidecar and the recording it names are encrypted
+func WriteSidecar(recordingPath string, sidecar *Sidecar, key *Key) (string, error) {
+	sidecar.File = filepath.Base(StoredPath(recordingPath, key))
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return WriteFile(SidecarPath(recordingPath), data, key)
+}
+
+// ReadSidecar reads a stored sidecar, decrypted if its name says so
+func ReadSidecar(path string, key *Key) (*Sidecar, error) {
+	data, err := ReadFile(path, key)
+	if err != nil {
+		return nil, err
+	}
+	var sidecar Sidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return nil, err
+	}
+	return &sidecar, nil
+}
+
+// WriteFileAtomic writes into a hidden file and renames it into place
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".partial")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
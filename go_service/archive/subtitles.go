@@ -0,0 +1,87 @@
+package archive
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SubtitleVtt = "vtt"
+	SubtitleSrt = "srt"
+)
+
+// a cue lasts until the next detection but no longer than this
+const maxCueDuration = time.Second
+
+type cue struct {
+	start time.Duration
+	end   time.Duration
+	lines []string
+}
+
+// SubtitlePath is the subtitle file of the given format next to a recording
+func SubtitlePath(recordingPath string, format string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + "." + format
+}
+
+// WriteSubtitles stores the detections of the sidecar as captions of
+// recordingPath, cue times are relative to the first frame of the clip
+func WriteSubtitles(recordingPath string, sidecar *Sidecar, format string, key *Key) (string, error) {
+	cues := subtitleCues(sidecar)
+	var out strings.Builder
+	switch format {
+	case SubtitleVtt:
+		out.WriteString("WEBVTT\n")
+		for _, c := range cues {
+			fmt.Fprintf(&out, "\n%s --> %s\n%s\n",
+				cueTime(c.start, "."), cueTime(c.end, "."), strings.Join(c.lines, "\n"))
+		}
+	case SubtitleSrt:
+		for i, c := range cues {
+			if i > 0 {
+				out.WriteString("\n")
+			}
+			fmt.Fprintf(&out, "%d\n%s --> %s\n%s\n",
+				i+1, cueTime(c.start, ","), cueTime(c.end, ","), strings.Join(c.lines, "\n"))
+		}
+	default:
+		return "", fmt.Errorf("unknown subtitle format %q", format)
+	}
+	return WriteFile(SubtitlePath(recordingPath, format), []byte(out.String()), key)
+}
+
+// subtitleCues makes one cue of the events sharing a timestamp
+func subtitleCues(sidecar *Sidecar) []cue {
+	clipEnd := sidecar.EndedAt.Sub(sidecar.StartedAt)
+	var cues []cue
+	for _, event := range sidecar.Events {
+		at := time.UnixMilli(event.TimestampMs).Sub(sidecar.StartedAt)
+		at = max(at, 0)
+		line := fmt.Sprintf("%s #%d (%.2f)", event.ClassName, event.TrackerId, event.Confidence)
+		if n := len(cues); n > 0 && cues[n-1].start == at {
+			cues[n-1].lines = append(cues[n-1].lines, line)
+			continue
+		}
+		cues = append(cues, cue{start: at, lines: []string{line}})
+	}
+	for i := range cues {
+		end := cues[i].start + maxCueDuration
+		if i+1 < len(cues) {
+			end = min(end, cues[i+1].start)
+		}
+		// detections on the last frame are shown for the full cue duration
+		if clipEnd > cues[i].start {
+			end = min(end, clipEnd)
+		}
+		// events of different trackers may arrive out of order
+		cues[i].end = max(end, cues[i].start+time.Millisecond)
+	}
+	return cues
+}
+
+func cueTime(d time.Duration, separator string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+)
+
+// ThumbnailPath is the poster image next to a recording
+func ThumbnailPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".jpg"
+}
+
+// WriteThumbnail stores the poster of recordingPath, with crop the
+// picture is cut to box grown by margin of its size on every side
+func WriteThumbnail(recordingPath string, frame []byte, box Box, crop bool, margin float64, key *Key) (string, error) {
+	data := frame
+	if crop {
+		cropped, err := cropJpeg(frame, box, margin)
+		if err != nil {
+			return "", err
+		}
+		data = cropped
+	}
+	return WriteFile(ThumbnailPath(recordingPath), data, key)
+}
+
+func cropJpeg(frame []byte, box Box, margin float64) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode thumbnail: %w", err)
+	}
+	dx := int(float64(box.Width) * margin)
+	dy := int(float64(box.Height) * margin)
+	rect := image.Rect(
+		int(box.X)-dx, int(box.Y)-dy,
+		int(box.X+box.Width)+dx, int(box.Y+box.Height)+dy,
+	).Intersect(img.Bounds())
+	if rect.Empty() {
+		return frame, nil
+	}
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return frame, nil
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, sub.SubImage(rect), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+	}
+	return out.Bytes(), nil
+}
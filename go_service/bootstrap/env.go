@@ -11,12 +11,60 @@ type Env struct {
 	APP_ENV                   string        `mapstructure:"APP_ENV"`
 	LOG_PATH                  string        `mapstructure:"LOG_PATH"`
 	RECORDINGS_TMP_DIR        string        `mapstructure:"RECORDINGS_TMP_DIR"`
+	RECORDER_BACKEND          string        `mapstructure:"RECORDER_BACKEND"`
+	ARCHIVE_DIR               string        `mapstructure:"ARCHIVE_DIR"`
+	ARCHIVE_LAYOUT            string        `mapstructure:"ARCHIVE_LAYOUT"`
+	OVERLAY_ENABLED           bool          `mapstructure:"OVERLAY_ENABLED"`
+	OVERLAY_COLORS            []string      `mapstructure:"OVERLAY_COLORS"`
+	OVERLAY_JPEG_QUALITY      int           `mapstructure:"OVERLAY_JPEG_QUALITY"`
+	SUBTITLE_FORMATS          []string      `mapstructure:"SUBTITLE_FORMATS"`
+	THUMBNAIL_CROP            bool          `mapstructure:"THUMBNAIL_CROP"`
+	THUMBNAIL_CROP_MARGIN     float64       `mapstructure:"THUMBNAIL_CROP_MARGIN"`
+	RECORDING_MODE            string        `mapstructure:"RECORDING_MODE"`
+	RECORDING_MODE_CAMERAS    []string      `mapstructure:"RECORDING_MODE_CAMERAS"`
+	SNAPSHOT_INTERVAL         time.Duration `mapstructure:"SNAPSHOT_INTERVAL"`
+	DVR_RETENTION             time.Duration `mapstructure:"DVR_RETENTION"`
+	DVR_LAYOUT                string        `mapstructure:"DVR_LAYOUT"`
+	DVR_INDEX_DIR             string        `mapstructure:"DVR_INDEX_DIR"`
+	TIMELAPSE_INTERVAL        time.Duration `mapstructure:"TIMELAPSE_INTERVAL"`
+	TIMELAPSE_PERIOD          string        `mapstructure:"TIMELAPSE_PERIOD"`
+	TIMELAPSE_FPS             int           `mapstructure:"TIMELAPSE_FPS"`
+	TIMELAPSE_LAYOUT          string        `mapstructure:"TIMELAPSE_LAYOUT"`
+	FRAME_QUEUE_SIZE          int           `mapstructure:"FRAME_QUEUE_SIZE"`
+	FRAME_QUEUE_DROP_POLICY   string        `mapstructure:"FRAME_QUEUE_DROP_POLICY"`
+	SEGMENT_MAX_DURATION      time.Duration `mapstructure:"SEGMENT_MAX_DURATION"`
+	SEGMENT_MAX_BYTES         int64         `mapstructure:"SEGMENT_MAX_BYTES"`
+	RETENTION_INTERVAL        time.Duration `mapstructure:"RETENTION_INTERVAL"`
+	RETENTION_MAX_AGE         time.Duration `mapstructure:"RETENTION_MAX_AGE"`
+	RETENTION_MAX_BYTES       int64         `mapstructure:"RETENTION_MAX_BYTES"`
+	RETENTION_CAMERA_BYTES    int64         `mapstructure:"RETENTION_CAMERA_BYTES"`
+	RETENTION_CAMERA_QUOTAS   []string      `mapstructure:"RETENTION_CAMERA_QUOTAS"`
+	RETENTION_TMP_MAX_AGE     time.Duration `mapstructure:"RETENTION_TMP_MAX_AGE"`
+	DISK_MIN_FREE_BYTES       int64         `mapstructure:"DISK_MIN_FREE_BYTES"`
+	DISK_CHECK_INTERVAL       time.Duration `mapstructure:"DISK_CHECK_INTERVAL"`
+	ENCRYPTION_KEY_FILE       string        `mapstructure:"ENCRYPTION_KEY_FILE"`
+	MANIFEST_DIR              string        `mapstructure:"MANIFEST_DIR"`
+	EXPORT_MAX_DURATION       time.Duration `mapstructure:"EXPORT_MAX_DURATION"`
+	LIVE_ENABLED              bool          `mapstructure:"LIVE_ENABLED"`
+	LIVE_SEGMENT_DURATION     time.Duration `mapstructure:"LIVE_SEGMENT_DURATION"`
+	LIVE_PLAYLIST_SIZE        int           `mapstructure:"LIVE_PLAYLIST_SIZE"`
+	LIVE_IDLE_TIMEOUT         time.Duration `mapstructure:"LIVE_IDLE_TIMEOUT"`
+	WEBRTC_ENABLED            bool          `mapstructure:"WEBRTC_ENABLED"`
+	WEBRTC_IP                 string        `mapstructure:"WEBRTC_IP"`
+	WEBRTC_PORT               string        `mapstructure:"WEBRTC_PORT"`
+	WEBRTC_ICE_SERVERS        []string      `mapstructure:"WEBRTC_ICE_SERVERS"`
+	CORS_ALLOWED_ORIGINS      []string      `mapstructure:"CORS_ALLOWED_ORIGINS"`
 	REST_IP                   string        `mapstructure:"REST_IP"`
 	REST_PORT                 string        `mapstructure:"REST_PORT"`
 	EVENT_SERVER_IP           string        `mapstructure:"EVENT_SERVER_IP"`
 	EVENT_SERVER_PORT         string        `mapstructure:"EVENT_SERVER_PORT"`
 	SESSION_TASK_TIMER        time.Duration `mapstructure:"SESSION_TASK_TIMER"`
 	TARGET_THRESHOLD_DURATION time.Duration `mapstructure:"TARGET_THRESHOLD_DURATION"`
+	PRE_ROLL                  time.Duration `mapstructure:"PRE_ROLL"`
+	PRE_ROLL_MAX_BYTES        int64         `mapstructure:"PRE_ROLL_MAX_BYTES"`
+	PRE_ROLL_GLOBAL_MAX_BYTES int64         `mapstructure:"PRE_ROLL_GLOBAL_MAX_BYTES"`
+	ARM_DELAY                 time.Duration `mapstructure:"ARM_DELAY"`
+	POST_ROLL                 time.Duration `mapstructure:"POST_ROLL"`
 	SESSION_ALLOWED_CLASSES   []string      `mapstructure:"SESSION_ALLOWED_CLASSES"`
 	DB_HOST                   string        `mapstructure:"DB_HOST"`
 	DB_NAME                   string        `mapstructure:"DB_NAME"`
@@ -29,6 +77,24 @@ func NewEnv(configPath string) *Env {
 	viper.SetConfigType("env")
 	viper.AutomaticEnv()
 
+	viper.SetDefault("SUBTITLE_FORMATS", "vtt")
+	viper.SetDefault("SNAPSHOT_INTERVAL", "5s")
+	viper.SetDefault("DVR_RETENTION", "24h")
+	viper.SetDefault("RETENTION_TMP_MAX_AGE", "24h")
+	viper.SetDefault("TIMELAPSE_PERIOD", "hour")
+	viper.SetDefault("TIMELAPSE_FPS", 25)
+	viper.SetDefault("EXPORT_MAX_DURATION", "1h")
+	viper.SetDefault("LIVE_SEGMENT_DURATION", "2s")
+	viper.SetDefault("LIVE_PLAYLIST_SIZE", 6)
+	viper.SetDefault("LIVE_IDLE_TIMEOUT", "30s")
+	viper.SetDefault("WEBRTC_PORT", "8083")
+	viper.SetDefault("CORS_ALLOWED_ORIGINS", "")
+	viper.SetDefault("DISK_MIN_FREE_BYTES", 1<<30)
+	viper.SetDefault("DISK_CHECK_INTERVAL", "10s")
+	viper.SetDefault("PRE_ROLL", "5s")
+	viper.SetDefault("PRE_ROLL_MAX_BYTES", 32<<20)
+	viper.SetDefault("PRE_ROLL_GLOBAL_MAX_BYTES", 256<<20)
+
 	err := viper.ReadInConfig()
 	if err != nil {
 		logrus.Fatalf("can't find the file: %s", err.Error())
@@ -39,6 +105,14 @@ func NewEnv(configPath string) *Env {
 		logrus.Fatalf("environment can't be loaded: %s", err.Error())
 	}
 
+	// older configs have one threshold for arming and disarming
+	if !viper.IsSet("ARM_DELAY") {
+		env.ARM_DELAY = env.TARGET_THRESHOLD_DURATION
+	}
+	if !viper.IsSet("POST_ROLL") {
+		env.POST_ROLL = env.TARGET_THRESHOLD_DURATION
+	}
+
 	if env.APP_ENV == "development" {
 		logrus.Info("the App is running in development env")
 	}
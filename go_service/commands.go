@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/bootstrap"
+	"yolo-detector-service/export"
+)
+
+// commands are offline tools, run as: yolo-detector-service <command> [flags]
+var commands = map[string]func(args []string) error{
+	"decrypt": decryptCommand,
+	"verify":  verifyCommand,
+	"export":  exportCommand,
+}
+
+// runCommand runs the command named by the first argument,
+// it returns false when the arguments are a config path instead
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+func decryptCommand(args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "key file, as ENCRYPTION_KEY_FILE of the service")
+	output := flags.String("o", "", "output file, - for stdout, default is the input without "+archive.EncryptedExt)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: decrypt -key FILE [-o OUTPUT] FILE"+archive.EncryptedExt+"...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keyFile == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("a key file and at least one input are required")
+	}
+	if *output != "" && flags.NArg() > 1 {
+		return errors.New("-o works with a single input only")
+	}
+	key, err := archive.LoadKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	for _, input := range flags.Args() {
+		target := *output
+		if target == "" {
+			if !archive.IsEncrypted(input) {
+				return fmt.Errorf("%s has no %s suffix, name the output with -o", input, archive.EncryptedExt)
+			}
+			target = strings.TrimSuffix(input, archive.EncryptedExt)
+		}
+		if target == "-" {
+			err = decryptToStdout(input, key)
+		} else {
+			err = archive.DecryptFile(input, target, key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", input, err)
+		}
+		if target != "-" {
+			fmt.Fprintf(os.Stderr, "%s -> %s\n", input, target)
+		}
+	}
+	return nil
+}
+
+func decryptToStdout(input string, key *archive.Key) error {
+	file, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	plain, err := archive.NewDecryptReader(file, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, plain)
+	return err
+}
+
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	camera := flags.String("camera", "", "check the manifest of this camera only")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: verify [-camera ID] CONFIG")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("the config of the service is required")
+	}
+	env := bootstrap.NewEnv(flags.Arg(0))
+	report, err := archive.NewManifest(env).Verify(*camera)
+	if err != nil {
+		return err
+	}
+	for _, problem := range report.Problems {
+		fmt.Printf("FAIL camera %s entry %d %s: %s\n", problem.Camera, problem.Seq, problem.Path, problem.Issue)
+	}
+	fmt.Printf("%d cameras, %d entries, %d files checked, %d problems\n",
+		report.Cameras, report.Entries, report.Files, len(report.Problems))
+	if len(report.Problems) > 0 {
+		return errors.New("the archive does not match its manifest")
+	}
+	return nil
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	camera := flags.String("camera", "", "camera to export")
+	fromValue := flags.String("from", "", "start, RFC 3339, local 2006-01-02T15:04[:05] or 15:04[:05] of today")
+	toValue := flags.String("to", "", "end, as -from")
+	output := flags.String("o", "", "output file, default is named after the camera and the range")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: export -camera ID -from TIME -to TIME [-o OUTPUT] CONFIG")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *camera == "" || *fromValue == "" || *toValue == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("a camera, a range and the config of the service are required")
+	}
+	now := time.Now()
+	from, err := export.ParseTime(*fromValue, now)
+	if err != nil {
+		return err
+	}
+	to, err := export.ParseTime(*toValue, now)
+	if err != nil {
+		return err
+	}
+	env := bootstrap.NewEnv(flags.Arg(0))
+	var key *archive.Key
+	if env.ENCRYPTION_KEY_FILE != "" {
+		if key, err = archive.LoadKey(env.ENCRYPTION_KEY_FILE); err != nil {
+			return err
+		}
+	}
+	clip, err := export.New(env, key).Export(*camera, from, to)
+	if err != nil {
+		return err
+	}
+	target := *output
+	if target == "" {
+		target = clip.Name
+	}
+	if err := archive.MoveFile(clip.Path, target); err != nil {
+		os.Remove(clip.Path)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d recordings\n", target, len(clip.Sources))
+	return nil
+}
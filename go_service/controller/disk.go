@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"sync"
+	"syscall"
+	"time"
+	"yolo-detector-service/bootstrap"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultDiskCheckInterval = 10 * time.Second
+
+// DiskGuard watches the free space of RECORDINGS_TMP_DIR,
+// below DISK_MIN_FREE_BYTES sessions do not record
+type DiskGuard struct {
+	path      string
+	minFree   uint64
+	interval  time.Duration
+	lock      sync.Mutex
+	checkedAt time.Time
+	free      uint64
+	low       bool
+}
+
+type DiskStatus struct {
+	Path      string    `json:"path"`
+	FreeBytes uint64    `json:"free_bytes"`
+	MinFree   uint64    `json:"min_free_bytes"`
+	Low       bool      `json:"low"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func NewDiskGuard(env *bootstrap.Env) *DiskGuard {
+	g := &DiskGuard{
+		path:     env.RECORDINGS_TMP_DIR,
+		interval: env.DISK_CHECK_INTERVAL,
+	}
+	if env.DISK_MIN_FREE_BYTES > 0 {
+		g.minFree = uint64(env.DISK_MIN_FREE_BYTES)
+	}
+	if g.interval <= 0 {
+		g.interval = defaultDiskCheckInterval
+	}
+	return g
+}
+
+// Low tells if free space is below the floor, measured at most once per DISK_CHECK_INTERVAL
+func (g *DiskGuard) Low() bool {
+	if g == nil || g.minFree == 0 {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if time.Since(g.checkedAt) >= g.interval {
+		g.check()
+	}
+	return g.low
+}
+
+// Check measures free space now, before a recording is armed
+func (g *DiskGuard) Check() bool {
+	if g == nil || g.minFree == 0 {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.check()
+	return g.low
+}
+
+func (g *DiskGuard) Status() DiskStatus {
+	if g == nil {
+		return DiskStatus{}
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return DiskStatus{
+		Path:      g.path,
+		FreeBytes: g.free,
+		MinFree:   g.minFree,
+		Low:       g.low,
+		CheckedAt: g.checkedAt,
+	}
+}
+
+func (g *DiskGuard) check() {
+	g.checkedAt = time.Now()
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(g.path, &stat); err != nil {
+		// a volume we cannot read is not one to record on
+		logrus.Errorf("Failed to check free space of %s: %v", g.path, err)
+		g.free = 0
+		g.low = true
+		return
+	}
+	g.free = stat.Bavail * uint64(stat.Bsize)
+	low := g.free < g.minFree
+	if low && !g.low {
+		logrus.WithFields(logrus.Fields{
+			"path":       g.path,
+			"free_bytes": g.free,
+			"min_free":   g.minFree,
+		}).Error("Disk space low, recording is suspended")
+	} else if !low && g.low {
+		logrus.WithField("free_bytes", g.free).Infof("Disk space of %s recovered, recording is resumed", g.path)
+	}
+	g.low = low
+}
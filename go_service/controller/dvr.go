@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+	"yolo-detector-service/archive"
+	pb "yolo-detector-service/grpc/generated"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultDvrSegment splits the continuous recording when SEGMENT_MAX_DURATION
+// is unlimited, the DVR window is kept by deleting whole segments
+const defaultDvrSegment = 10 * time.Minute
+
+// dvrTick is the session timer in DVR mode, called with the session lock held,
+// the target does not start or stop the recording, it only sets event markers
+func (cc *TrackerSession) dvrTick() {
+	cc.reportDrops()
+	switch cc.state {
+	case StateIdle:
+		if cc.trackerTime.noTargetFor(cc.env.ARM_DELAY) {
+			// gone before the event was armed
+			cc.trackerTime.clear()
+		} else if cc.trackerTime.hasTargetFor(cc.env.ARM_DELAY) {
+			first := cc.trackerTime.firstEvent
+			// lastEvent is kept, the end of the event counts from it
+			cc.trackerTime.firstEvent = nil
+			cc.startEvent(first)
+			cc.state = StateRun
+		}
+	case StateRun:
+		if cc.trackerTime.noTargetFor(cc.env.POST_ROLL) {
+			cc.endEvent(eventTime(cc.trackerTime.lastEvent))
+			cc.trackerTime.clear()
+			cc.state = StateIdle
+		}
+	}
+	cc.keepRecording()
+}
+
+// keepRecording keeps the continuous recording going while there is disk space
+func (cc *TrackerSession) keepRecording() {
+	switch {
+	case cc.disk.Low():
+		if cc.recording != nil {
+			logrus.Errorf("[%s] Disk space is below the floor, DVR recording paused", cc.addr)
+			cc.closePipeline()
+		}
+	case cc.recording == nil:
+		if err := cc.startPipeline(""); err != nil {
+			logrus.Errorf("[%s] Failed to start DVR recording: %v", cc.addr, err)
+		}
+	case cc.recorder == nil:
+		// the previous recorder died or failed to start
+		if err := cc.startSegment(); err != nil {
+			logrus.Errorf("[%s] Failed to restart DVR recording: %v", cc.addr, err)
+		}
+	}
+}
+
+// startEvent marks where the target appeared, first is the event that armed it
+func (cc *TrackerSession) startEvent(first *pb.TrackEvent) {
+	cc.eventCount += 1
+	cc.openEvent = &archive.Marker{
+		Time:      eventTime(first),
+		Action:    archive.MarkerStart,
+		Camera:    cc.camera,
+		SessionId: cc.sessionId,
+		Event:     fmt.Sprintf("session_%04d_event_%03d", cc.sessionId, cc.eventCount),
+		Class:     first.GetClassName(),
+	}
+	cc.mark(*cc.openEvent)
+}
+
+// endEvent marks the end of the open event, if there is one
+func (cc *TrackerSession) endEvent(at time.Time) {
+	if cc.openEvent == nil {
+		return
+	}
+	marker := *cc.openEvent
+	marker.Time = at
+	marker.Action = archive.MarkerEnd
+	cc.openEvent = nil
+	cc.mark(marker)
+}
+
+func (cc *TrackerSession) mark(marker archive.Marker) {
+	if err := cc.markers.Append(marker); err != nil {
+		logrus.Errorf("[%s] Failed to write %s marker of %s: %v", cc.addr, marker.Action, marker.Event, err)
+		return
+	}
+	logrus.Printf("[%s] DVR event %s %s, class: %s", cc.addr, marker.Event, marker.Action, marker.Class)
+}
+
+// eventTime is when the detector saw the event, now if it did not say
+func eventTime(event *pb.TrackEvent) time.Time {
+	if event.GetTimestampMs() == 0 {
+		return time.Now()
+	}
+	return time.UnixMilli(event.GetTimestampMs())
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"yolo-detector-service/recorder"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	livePlaylist  = "index.m3u8"
+	liveQueueSize = 32
+)
+
+var ErrLiveStopped = errors.New("live encoder exited")
+
+// liveStream encodes the frames of a session into a rolling HLS playlist
+// while someone watches it, the encoder starts with the first request
+// and stops after LIVE_IDLE_TIMEOUT without one
+type liveStream struct {
+	session *TrackerSession
+	dir     string
+	queue   *frameQueue
+	done    chan struct{}
+
+	lock      sync.Mutex
+	recorder  recorder.Recorder
+	watchedAt time.Time
+}
+
+// newLiveStream returns nil when LIVE_ENABLED is off
+func newLiveStream(session *TrackerSession) *liveStream {
+	if !session.env.LIVE_ENABLED {
+		return nil
+	}
+	return &liveStream{
+		session: session,
+		dir:     filepath.Join(session.env.RECORDINGS_TMP_DIR, ".live", fmt.Sprintf("session_%04d", session.sessionId)),
+		// viewers lose frames, never the recording
+		queue: newFrameQueue(liveQueueSize, DropOldest),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *liveStream) start() {
+	if l == nil {
+		return
+	}
+	go l.run()
+}
+
+// offer passes the frame on while someone watches
+func (l *liveStream) offer(frame recorder.Frame) {
+	if l == nil || !l.watched() {
+		return
+	}
+	l.queue.push(frame)
+}
+
+func (l *liveStream) watched() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.recorder != nil
+}
+
+func (l *liveStream) run() {
+	defer close(l.done)
+	for frame := range l.queue.frames {
+		l.lock.Lock()
+		rec := l.recorder
+		l.lock.Unlock()
+		if rec == nil {
+			continue
+		}
+		err := rec.WriteFrame(frame)
+		if err != nil && !errors.Is(err, recorder.ErrNotStarted) && !errors.Is(err, recorder.ErrProcessExited) {
+			logrus.Warnf("[%s] Failed to write live frame: %v", l.session.addr, err)
+		}
+	}
+}
+
+// watch starts the encoder if it is not running and keeps it
+// from going idle, it returns the playlist once it is written
+func (l *liveStream) watch(wait time.Duration) (string, error) {
+	l.lock.Lock()
+	rec := l.recorder
+	if rec != nil {
+		select {
+		case <-rec.Done():
+			// died, e.g. ffmpeg is missing, the next request tries again
+			l.recorder = nil
+			l.lock.Unlock()
+			go l.stopEncoder(rec)
+			return "", ErrLiveStopped
+		default:
+		}
+	} else {
+		os.RemoveAll(l.dir)
+		if err := os.MkdirAll(l.dir, 0755); err != nil {
+			l.lock.Unlock()
+			return "", err
+		}
+		env := l.session.env
+		rec = recorder.NewHls(env.LIVE_SEGMENT_DURATION, env.LIVE_PLAYLIST_SIZE)
+		if err := rec.Start(filepath.Join(l.dir, "index")); err != nil {
+			l.lock.Unlock()
+			return "", err
+		}
+		l.recorder = rec
+		logrus.Printf("[%s] Live view of session %d started", l.session.addr, l.session.sessionId)
+	}
+	l.watchedAt = time.Now()
+	l.lock.Unlock()
+
+	playlist := filepath.Join(l.dir, livePlaylist)
+	deadline := time.Now().Add(wait)
+	for {
+		if _, err := os.Stat(playlist); err == nil {
+			return playlist, nil
+		}
+		select {
+		case <-rec.Done():
+			return "", ErrLiveStopped
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no live segment after %v, is the camera sending frames?", wait)
+		}
+	}
+}
+
+// segment returns the path of a segment of the playlist, requests keep the encoder going
+func (l *liveStream) segment(name string) (string, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.recorder == nil || name != filepath.Base(name) || filepath.Ext(name) != ".ts" {
+		return "", os.ErrNotExist
+	}
+	l.watchedAt = time.Now()
+	return filepath.Join(l.dir, name), nil
+}
+
+// tick stops the encoder once nobody has watched for LIVE_IDLE_TIMEOUT
+func (l *liveStream) tick() {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	rec := l.recorder
+	if rec == nil || time.Since(l.watchedAt) < l.session.env.LIVE_IDLE_TIMEOUT {
+		l.lock.Unlock()
+		return
+	}
+	l.recorder = nil
+	l.lock.Unlock()
+	logrus.Printf("[%s] Live view of session %d idle, stopping", l.session.addr, l.session.sessionId)
+	go l.stopEncoder(rec)
+}
+
+func (l *liveStream) stopEncoder(rec recorder.Recorder) {
+	if err := rec.Stop(); err != nil {
+		logrus.Debugf("[%s] Live encoder: %v", l.session.addr, err)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.recorder == nil {
+		// not restarted meanwhile
+		os.RemoveAll(l.dir)
+	}
+}
+
+// close ends the live view with the session and removes its files
+func (l *liveStream) close() {
+	if l == nil {
+		return
+	}
+	l.queue.close()
+	<-l.done
+	l.lock.Lock()
+	rec := l.recorder
+	l.recorder = nil
+	l.lock.Unlock()
+	if rec != nil {
+		l.stopEncoder(rec)
+	}
+	os.RemoveAll(l.dir)
+}
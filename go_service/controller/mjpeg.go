@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// frames a viewer may lag behind before it loses the oldest
+	mjpegViewerQueue  = 2
+	mjpegBoundary     = "frame"
+	mjpegWriteTimeout = 10 * time.Second
+)
+
+// mjpegHub fans the frames of a session out to its MJPEG viewers, every
+// viewer has a queue of its own so a lagging browser only loses frames,
+// it never holds up the stream or the other viewers
+type mjpegHub struct {
+	lock    sync.Mutex
+	viewers map[*mjpegViewer]struct{}
+	closed  bool
+}
+
+type mjpegViewer struct {
+	frames chan []byte
+	// under the hub lock
+	dropped int64
+}
+
+func newMjpegHub() *mjpegHub {
+	return &mjpegHub{viewers: make(map[*mjpegViewer]struct{})}
+}
+
+// subscribe adds a viewer, nil once the session has ended
+func (h *mjpegHub) subscribe() *mjpegViewer {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil
+	}
+	viewer := &mjpegViewer{frames: make(chan []byte, mjpegViewerQueue)}
+	h.viewers[viewer] = struct{}{}
+	return viewer
+}
+
+// unsubscribe removes the viewer, it returns how many frames it lost
+func (h *mjpegHub) unsubscribe(viewer *mjpegViewer) int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.viewers, viewer)
+	return viewer.dropped
+}
+
+// broadcast never blocks, a full viewer queue loses its oldest frame
+func (h *mjpegHub) broadcast(frame []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for viewer := range h.viewers {
+		select {
+		case viewer.frames <- frame:
+			continue
+		default:
+		}
+		select {
+		case <-viewer.frames:
+			viewer.dropped += 1
+		default:
+			// the viewer took one meanwhile
+		}
+		// only the hub sends, under its lock, so there is room now
+		viewer.frames <- frame
+	}
+}
+
+func (h *mjpegHub) count() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.viewers)
+}
+
+// close ends the streams of all viewers with the session
+func (h *mjpegHub) close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for viewer := range h.viewers {
+		close(viewer.frames)
+		delete(h.viewers, viewer)
+	}
+}
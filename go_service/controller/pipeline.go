@@ -3,193 +3,342 @@ package controller
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/recorder"
 
 	"github.com/sirupsen/logrus"
 )
 
-func (s *TrackerSession) startPipeline() error {
+// recording is one event, written as one or more segments
+// when the segment limits are hit or the recorder had to be restarted
+type recording struct {
+	id        string
+	trigger   string
+	startedAt time.Time
+	// segments opened so far, stopped ones finish on their own
+	segments int
+	// what was detected in the open segment
+	current *segmentLog
+	// allowed classes seen in the whole event
+	classes map[string]bool
+	// the tail is being written, no more frames are queued
+	closing bool
+}
+
+// segmentLog collects the detections written into one segment
+type segmentLog struct {
+	segment int
+	classes map[string]bool
+	events  []archive.TrackEvent
+	// frame with the most confident allowed detection, the poster of the clip
+	best           []byte
+	bestBox        archive.Box
+	bestConfidence float32
+}
+
+// startPipeline opens a new recording event with its first segment,
+// trigger is the class that armed it
+func (s *TrackerSession) startPipeline(trigger string) error {
 	s.recordCount += 1
-	fileName := fmt.Sprintf("session_%04d_%03d.mp4", s.sessionId, s.recordCount)
-	path := path.Join(s.env.RECORDINGS_TMP_DIR, fileName)
-	args := []string{
-		"fdsrc", "do-timestamp=true",
-		"!", "image/jpeg",
-		"!", "jpegparse",
-		"!", "jpegdec",
-		"!", "videoconvert",
-		"!", "videorate",
-		"!", "video/x-raw,framerate=30/1",
-		"!", "x264enc", "tune=zerolatency", "speed-preset=ultrafast",
-		"!", "h264parse",
-		"!", "mp4mux", "fragment-duration=2000",
-		"!", "filesink",
-		"location=" + path, "sync=false",
-	}
-
-	s.gstCmd = exec.Command("gst-launch-1.0", args...)
-
-	// 1. Get STDIN pipe (for sending data to GStreamer)
-	var err error
-	s.gstIn, err = s.gstCmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to get stdin pipe: %w", err)
+	s.recording = &recording{
+		id:        fmt.Sprintf("session_%04d_%03d", s.sessionId, s.recordCount),
+		trigger:   trigger,
+		startedAt: time.Now(),
+		classes:   make(map[string]bool),
 	}
+	return s.startSegment()
+}
 
-	// 2. Set STDERR (for capturing crash reasons)
-	// s.gstCmd.Stderr = &stderr
-	s.gstCmd.Stderr = os.Stderr
-	s.gstCmd.Stdout = os.Stdout // Optional: keep stdout visible
+// startSegment opens the next segment of the current recording
+func (s *TrackerSession) startSegment() error {
+	segment := s.recording.segments + 1
+	fileName := fmt.Sprintf("%s_%02d", s.recording.id, segment)
+	basePath := path.Join(s.env.RECORDINGS_TMP_DIR, fileName)
 
-	// 3. Start the GStreamer pipeline process
-	if err := s.gstCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start gst-launch: %w", err)
-		// return fmt.Errorf("failed to start gst-launch: %w (stderr: %s)", err, stderr.String())
+	rec := recorder.New(s.env)
+	if s.mode == ModeSnapshot {
+		rec = recorder.NewSnapshot()
+	}
+	if err := rec.Start(basePath); err != nil {
+		return err
 	}
+	s.recorder = rec
+	s.recording.segments = segment
+	s.recording.current = &segmentLog{segment: segment, classes: make(map[string]bool)}
+	go s.superviseRecorder(rec)
+	return nil
+}
 
-	// Now, launch a goroutine to wait for the GStreamer process to finish
-	// This allows us to log the crash reason immediately.
-	// go func() {
-	// 	if err := s.gstCmd.Wait(); err != nil {
-	// 		// This runs if the GStreamer process exits with a non-zero code (crashed)
-	// 		logrus.Printf("!!! GStreamer CRASHED or EXITED")
-	// 		// logrus.Printf("!!! Crash Reason (stderr): %s", stderr.String())
-	// 		logrus.Printf("!!! Exit Error: %v", err)
-	// 		// You might want to close the gRPC connection (or send a signal) here
-	// 	}
-	// }()
+// superviseRecorder notices a recorder ending on its own, the partial file
+// is closed and the session timer starts a new segment if the target is still there
+func (s *TrackerSession) superviseRecorder(rec recorder.Recorder) {
+	<-rec.Done()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.recorder != rec {
+		// stopped by the session
+		return
+	}
+	info := rec.Info()
+	logrus.WithFields(logrus.Fields{
+		"session":   s.sessionId,
+		"backend":   info.Backend,
+		"path":      info.Path,
+		"frames":    info.Frames,
+		"truncated": info.Truncated,
+	}).Warn("Recorder ended unexpectedly, waiting for a new segment")
+	s.stopSegment()
+}
 
-	logrus.Printf("GStreamer pipeline started")
+// rolloverSegment replaces the open segment with the next one, the new
+// recorder is running before the old one is stopped so no frame is lost
+func (s *TrackerSession) rolloverSegment() error {
+	previous := s.recorder
+	log := s.recording.current
+	if err := s.startSegment(); err != nil {
+		return err
+	}
+	s.finishSegment(previous, log)
 	return nil
 }
 
-func (s *TrackerSession) stopPipeline() error {
-	if s.gstIn != nil {
-		s.gstIn.Close()
+func (s *TrackerSession) stopSegment() {
+	if s.recorder == nil {
+		return
+	}
+	rec := s.recorder
+	s.recorder = nil
+	s.finishSegment(rec, s.recording.current)
+}
+
+// finishSegment is called with the session lock held once nothing more is
+// written to rec, the encoder may take a while to exit and the file to move,
+// the session does not wait for either
+func (s *TrackerSession) finishSegment(rec recorder.Recorder, log *segmentLog) {
+	id := s.recording.id
+	trigger := s.recording.trigger
+	classes := log.classes
+	if len(classes) == 0 && s.mode != ModeDvr {
+		// e.g. a segment holding only post-roll
+		classes = s.recording.classes
+	}
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	s.finalizing.Add(1)
+	go func() {
+		defer s.finalizing.Done()
+		if err := rec.Stop(); err != nil {
+			logrus.Printf("Recorder exited with error: %v", err)
+		}
+		info := rec.Info()
+		logrus.Printf("Segment %d of %s finished [%s], frames: %d, bytes: %d",
+			log.segment, id, info.Path, info.Frames, info.Bytes)
+		if info.Frames == 0 || info.Backend == recorder.BackendNoop {
+			return
+		}
+		entry := archive.Entry{
+			Camera:  s.camera,
+			Session: s.sessionId,
+			Event:   id,
+			Segment: log.segment,
+			Start:   info.FirstFrameAt,
+			Path:    info.Path,
+			Classes: names,
+		}
+		sidecar := &archive.Sidecar{
+			SessionId:    s.sessionId,
+			Peer:         s.addr,
+			Camera:       s.camera,
+			Event:        id,
+			Segment:      entry.Segment,
+			Mode:         s.mode,
+			Backend:      info.Backend,
+			StartedAt:    info.FirstFrameAt,
+			EndedAt:      info.LastFrameAt,
+			Frames:       info.Frames,
+			Truncated:    info.Truncated,
+			TriggerClass: trigger,
+			Classes:      entry.Classes,
+			Events:       log.events,
+		}
+		s.finalizeSegment(entry, sidecar, log)
+	}()
+}
+
+// finalizeSegment puts the companion files in place first,
+// so whoever finds the recording in the archive finds them too
+func (s *TrackerSession) finalizeSegment(entry archive.Entry, sidecar *archive.Sidecar, log *segmentLog) {
+	target, err := s.archiveTarget(entry)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to archive %s: %v", entry.Path, err)
+		return
 	}
-	if s.gstCmd != nil {
-		err := s.gstCmd.Wait()
+	if log.best != nil && s.mode != ModeSnapshot {
+		thumbnail, err := archive.WriteThumbnail(target, log.best, log.bestBox,
+			s.env.THUMBNAIL_CROP, s.env.THUMBNAIL_CROP_MARGIN, s.key)
 		if err != nil {
-			logrus.Printf("GStreamer exited with error: %v", err)
+			logrus.Errorf("Failed to write thumbnail of %s: %v", target, err)
+		} else {
+			sidecar.Thumbnail = filepath.Base(thumbnail)
 		}
 	}
-	logrus.Println("GStreamer finished")
-	return nil
+	formats := s.env.SUBTITLE_FORMATS
+	if s.mode == ModeSnapshot {
+		// a still has no timeline, the sidecar lists its detections
+		formats = nil
+	}
+	for _, format := range formats {
+		subtitles, err := archive.WriteSubtitles(target, sidecar, strings.TrimSpace(format), s.key)
+		if err != nil {
+			logrus.Errorf("Failed to write subtitles of %s: %v", target, err)
+			continue
+		}
+		sidecar.Subtitles = append(sidecar.Subtitles, filepath.Base(subtitles))
+	}
+	stored := []string{archive.StoredPath(target, s.key)}
+	if path, err := archive.WriteSidecar(target, sidecar, s.key); err != nil {
+		logrus.Errorf("Failed to write sidecar of %s: %v", target, err)
+	} else {
+		stored = append(stored, path)
+	}
+	if err := archive.Finalize(entry, target, s.key); err != nil {
+		logrus.Errorf("Failed to archive %s: %v", entry.Path, err)
+		return
+	}
+	if sidecar.Thumbnail != "" {
+		stored = append(stored, filepath.Join(filepath.Dir(target), sidecar.Thumbnail))
+	}
+	for _, name := range sidecar.Subtitles {
+		stored = append(stored, filepath.Join(filepath.Dir(target), name))
+	}
+	if err := s.manifest.Add(s.camera, stored); err != nil {
+		logrus.Errorf("Failed to add %s to the manifest: %v", target, err)
+	}
+	logrus.Printf("Segment archived [%s]", stored[0])
+}
+
+// archiveTarget places the continuous DVR recording apart from the clips
+func (s *TrackerSession) archiveTarget(entry archive.Entry) (string, error) {
+	if s.mode != ModeDvr {
+		return archive.Target(s.env, entry)
+	}
+	layout := s.env.DVR_LAYOUT
+	if layout == "" {
+		layout = archive.DefaultDvrLayout
+	}
+	return archive.TargetIn(s.env, entry, layout)
+}
+
+// stopPipeline closes the last segment and ends the recording event,
+// frames still queued for it are lost, see closePipeline
+func (s *TrackerSession) stopPipeline() {
+	if s.recording == nil {
+		return
+	}
+	s.stopSegment()
+	logrus.Printf("Recording %s finished, segments: %d", s.recording.id, s.recording.segments)
+	s.recording = nil
+}
+
+// closePipeline is stopPipeline once the writer has written the frames
+// already queued, called with the session lock held, which it releases
+// meanwhile. Frames are not queued for the recording any more
+func (s *TrackerSession) closePipeline() {
+	if s.recording == nil {
+		return
+	}
+	s.recording.closing = true
+	s.lock.Unlock()
+	s.queue.wait()
+	s.lock.Lock()
+	s.stopPipeline()
+}
+
+// segmentFull tells if the frame has to go into a new segment
+func (s *TrackerSession) segmentFull(frame recorder.Frame) bool {
+	info := s.recorder.Info()
+	if info.Frames == 0 {
+		return false
+	}
+	if s.mode == ModeSnapshot {
+		return frame.Timestamp.Sub(info.FirstFrameAt) >= s.env.SNAPSHOT_INTERVAL
+	}
+	maxDuration := s.env.SEGMENT_MAX_DURATION
+	if s.mode == ModeDvr && maxDuration <= 0 {
+		maxDuration = defaultDvrSegment
+	}
+	if maxDuration > 0 && frame.Timestamp.Sub(info.FirstFrameAt) >= maxDuration {
+		return true
+	}
+	maxBytes := s.env.SEGMENT_MAX_BYTES
+	return maxBytes > 0 && info.Bytes >= maxBytes
+}
+
+// writeFrame runs on the session writer, the encoder is fed outside
+// the session lock so a slow encoder does not hold up the stream
+func (s *TrackerSession) writeFrame(frame recorder.Frame) error {
+	s.lock.Lock()
+	rec := s.logFrame(frame)
+	s.lock.Unlock()
+	if rec == nil {
+		return nil
+	}
+	if s.overlay != nil && len(frame.Events) > 0 {
+		data, err := s.overlay.Draw(frame.Data, frame.Events)
+		if err != nil {
+			logrus.Warnf("Failed to draw overlay, frame recorded without it: %v", err)
+		} else {
+			frame.Data = data
+		}
+	}
+	err := rec.WriteFrame(frame)
+	if err != nil {
+		logrus.Errorf("Error writing frame to recorder: %v", err)
+	}
+	return err
 }
 
-// args := []string{
-// 	// "fdsrc",
-// 	// "!",
-// 	// "filesink", "location=/home/khomin/Desktop/capture1.jpeg", "buffer-mode=0",
-
-// 	// "fdsrc", // "do-timestamp=true", // Tell GStreamer to time the frames as they arrive
-// 	// "!",
-// 	// "image/jpeg", //,framerate=30/1", // Force a framerate so the video has a "speed"
-// 	// "!",
-// 	// "jpegparse", // ASSEMBLER: Ensures the encoder gets 100% of the image
-// 	// "!",
-// 	// "jpegdec",
-// 	// "!",
-// 	// "videoconvert",
-// 	// "!",
-// 	// "x264enc", // "tune=zerolatency", "speed-preset=ultrafast",
-// 	// "!",
-// 	// "h264parse",
-// 	// "!",
-// 	// "mp4mux",
-// 	// "!",
-// 	// "filesink", "location=/home/khomin/Desktop/capture1.mp4", //, "sync=false",
-
-// 	// "fdsrc",
-// 	// // 2. Define Input Caps (CRITICAL)
-// 	// // You must tell GStreamer this is JPEG and invent a framerate (e.g., 25 or 30 fps)
-// 	// // otherwise x264enc will refuse to start.
-// 	// "!", "image/jpeg", //,framerate=30/1",
-
-// 	// // 3. Parse the Bytes
-// 	// "!", "jpegparse", // Finds the start/end of each JPEG frame
-
-// 	// // 4. Decode JPEG to Raw Video
-// 	// "!", "jpegdec",
-
-// 	// // 5. Convert Color Space
-// 	// "!", "videoconvert", // Ensures compatibility with the encoder
-
-// 	// // 6. Encode to H.264
-// 	// // tune=zerolatency: Don't buffer frames; output immediately (prevents hangs)
-// 	// // speed-preset=ultrafast: Sacrifice quality for speed (crucial for ARM CPUs)
-// 	// "!", "x264enc", // "tune=zerolatency", "speed-preset=ultrafast",
-
-// 	// // 7. Parse H.264 stream (Safety for the muxer)
-// 	// "!", "h264parse",
-
-// 	// // 8. Container Muxing
-// 	// "!", "mp4mux",
-
-// 	// // 9. Write to File
-// 	// "!", "filesink", "location=/home/khomin/Desktop/capture1.mp4", //"sync=false",
-
-// 	// // #
-// 	// "fdsrc", "do-timestamp=true", // Reads from the pipe (your Go .Write calls)
-// 	// "!",
-// 	// "image/jpeg,framerate=30/1", // Tell GStreamer what the bytes are (CAPS ARE CRITICAL HERE)
-// 	// "!",
-// 	// "jpegparse", // robustly finds the start/end of JPEGs in the byte stream
-// 	// "!",
-// 	// "multipartmux", // wraps them into a playable MJPEG stream
-// 	// "!",
-// 	// "filesink", "location=/home/khomin/Desktop/capture_fixed.mjpeg", "sync=false",
-
-// 	// // # gemini pro already better
-// 	// "fdsrc", "do-timestamp=true",
-// 	// "!",
-// 	// "image/jpeg,framerate=5/1", // 1. Assume input is roughly 10 fps
-// 	// "!",
-// 	// "jpegparse",
-// 	// "!",
-// 	// "jpegdec", // 2. Decode so we can fix the timing
-// 	// "!",
-// 	// "videorate", // 3. SMOOTHING MAGIC: Fills gaps to make it steady
-// 	// "!",
-// 	// "video/x-raw,framerate=25/1", // 4. Output a standard 30fps stream (repeating frames if needed)
-// 	// "!",
-// 	// "jpegenc", // 5. Re-encode to JPEG (fast)
-// 	// "!",
-// 	// "multipartmux",
-// 	// "!",
-// 	// "filesink", "location=/home/khomin/Desktop/capture_fixed.mjpeg", "sync=false",
-
-// 	// "fdsrc", "do-timestamp=true",
-// 	// "!", "image/jpeg",
-// 	// "!", "jpegparse", // Fixes the green corruption (frame assembly)
-
-// 	// // 2. DECODE: We must decode to raw video to fix the timing
-// 	// "!", "jpegdec",
-
-// 	// // 3. THE GEARBOX: Fixes the "Time Lapse" / "Fast Forward" issue
-// 	// "!", "videorate",
-
-// 	// // 4. THE TARGET: Force the stream to become rigid 30fps
-// 	// // GStreamer will now duplicate your 7 frames into 30 frames per second
-// 	// "!", "video/x-raw,framerate=30/1",
-
-// 	// // 5. ENCODE: Now we have a perfect stream for x264
-// 	// "!", "videoconvert",
-// 	// "!", "x264enc", "tune=zerolatency", "speed-preset=ultrafast",
-// 	// "!", "h264parse",
-// 	// "!", "mp4mux",
-// 	// "!", "filesink", "location=/home/khomin/Desktop/capture_fixed.mp4", "sync=false",
-
-// 	"fdsrc", "do-timestamp=true",
-// 	"!", "image/jpeg",
-// 	"!", "jpegparse",
-// 	"!", "jpegdec",
-// 	"!", "videoconvert",
-// 	"!", "videorate",
-// 	"!", "video/x-raw,framerate=30/1",
-// 	"!", "x264enc", "tune=zerolatency", "speed-preset=ultrafast",
-// 	"!", "h264parse",
-// 	"!", "mp4mux", "fragment-duration=2000",
-// 	"!", "filesink", "location=/home/khomin/Desktop/capture_fixed.mp4", "sync=false",
-// }
+// logFrame rolls the segment over when it is full and notes what the frame shows,
+// it returns the recorder to write the frame to, nil if the frame is not recorded
+func (s *TrackerSession) logFrame(frame recorder.Frame) recorder.Recorder {
+	if s.recorder == nil {
+		return nil
+	}
+	if s.segmentFull(frame) {
+		if err := s.rolloverSegment(); err != nil {
+			logrus.Errorf("Failed to roll over to a new segment: %v", err)
+		}
+	}
+	if s.mode == ModeSnapshot && s.recorder.Info().Frames > 0 {
+		// the still of this interval is taken
+		return nil
+	}
+	log := s.recording.current
+	for _, event := range frame.Events {
+		tracked := archive.NewTrackEvent(event, frame.Timestamp)
+		log.events = append(log.events, tracked)
+		if !s.trackerTime.isAllowedClass(event.GetClassName()) {
+			continue
+		}
+		log.classes[event.GetClassName()] = true
+		s.recording.classes[event.GetClassName()] = true
+		if log.best == nil || tracked.Confidence > log.bestConfidence {
+			log.best = frame.Data
+			log.bestBox = tracked.Box
+			log.bestConfidence = tracked.Confidence
+		}
+	}
+	return s.recorder
+}
@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"sync"
+	"time"
+	"yolo-detector-service/recorder"
+)
+
+const minRingCapacity = 16
+
+// ByteBudget is the memory all sessions may use for pre-roll frames together
+type ByteBudget struct {
+	max  int64
+	used int64
+	lock sync.Mutex
+}
+
+// NewByteBudget returns a budget of max bytes, zero means unlimited
+func NewByteBudget(max int64) *ByteBudget {
+	return &ByteBudget{max: max}
+}
+
+func (b *ByteBudget) reserve(size int64) bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.max > 0 && b.used+size > b.max {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+func (b *ByteBudget) release(size int64) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= size
+}
+
+// frameRing keeps the newest frames within a time window and a byte limit,
+// the oldest frames are dropped first and the backing array shrinks again
+type frameRing struct {
+	frames   []recorder.Frame
+	head     int
+	size     int
+	bytes    int64
+	window   time.Duration
+	maxBytes int64
+	budget   *ByteBudget
+}
+
+func newFrameRing(window time.Duration, maxBytes int64, budget *ByteBudget) *frameRing {
+	return &frameRing{
+		window:   window,
+		maxBytes: maxBytes,
+		budget:   budget,
+	}
+}
+
+// push adds a frame, returns false if it did not fit even into an empty ring
+func (r *frameRing) push(frame recorder.Frame) bool {
+	size := int64(len(frame.Data))
+	if r.window <= 0 || (r.maxBytes > 0 && size > r.maxBytes) {
+		return false
+	}
+	oldest := frame.Timestamp.Add(-r.window)
+	for r.size > 0 && r.at(0).Timestamp.Before(oldest) {
+		r.dropOldest()
+	}
+	for r.maxBytes > 0 && r.size > 0 && r.bytes+size > r.maxBytes {
+		r.dropOldest()
+	}
+	for !r.budget.reserve(size) {
+		if r.size == 0 {
+			return false
+		}
+		r.dropOldest()
+	}
+	if r.size == len(r.frames) {
+		r.resize(max(minRingCapacity, 2*len(r.frames)))
+	}
+	r.frames[(r.head+r.size)%len(r.frames)] = frame
+	r.size += 1
+	r.bytes += size
+	return true
+}
+
+// drain returns the frames oldest first and empties the ring
+func (r *frameRing) drain() []recorder.Frame {
+	out := make([]recorder.Frame, r.size)
+	for i := range out {
+		out[i] = r.at(i)
+	}
+	r.clear()
+	return out
+}
+
+func (r *frameRing) clear() {
+	r.budget.release(r.bytes)
+	r.frames = nil
+	r.head = 0
+	r.size = 0
+	r.bytes = 0
+}
+
+func (r *frameRing) len() int {
+	return r.size
+}
+
+func (r *frameRing) at(i int) recorder.Frame {
+	return r.frames[(r.head+i)%len(r.frames)]
+}
+
+func (r *frameRing) dropOldest() {
+	size := int64(len(r.frames[r.head].Data))
+	r.frames[r.head] = recorder.Frame{}
+	r.head = (r.head + 1) % len(r.frames)
+	r.size -= 1
+	r.bytes -= size
+	r.budget.release(size)
+	if len(r.frames) > minRingCapacity && r.size < len(r.frames)/4 {
+		r.resize(len(r.frames) / 2)
+	}
+}
+
+func (r *frameRing) resize(capacity int) {
+	frames := make([]recorder.Frame, capacity)
+	for i := 0; i < r.size; i++ {
+		frames[i] = r.at(i)
+	}
+	r.frames = frames
+	r.head = 0
+}
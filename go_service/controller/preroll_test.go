@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+	"time"
+	"yolo-detector-service/recorder"
+)
+
+var testStart = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+// testFrame is a frame of size bytes taken at ms after testStart,
+// its first byte tells the frames apart
+func testFrame(id byte, ms int, size int) recorder.Frame {
+	data := make([]byte, size)
+	data[0] = id
+	return recorder.Frame{Data: data, Timestamp: testStart.Add(time.Duration(ms) * time.Millisecond)}
+}
+
+func frameIds(frames []recorder.Frame) []byte {
+	ids := make([]byte, 0, len(frames))
+	for _, frame := range frames {
+		ids = append(ids, frame.Data[0])
+	}
+	return ids
+}
+
+func TestFrameRingPush(t *testing.T) {
+	type push struct {
+		ms   int
+		size int
+		// false if the ring refuses the frame
+		kept bool
+	}
+	tests := []struct {
+		name      string
+		window    time.Duration
+		maxBytes  int64
+		budgetMax int64
+		pushes    []push
+		// frames left, by their position in pushes, oldest first
+		want []byte
+	}{
+		{
+			name:   "pre-roll off",
+			window: 0,
+			pushes: []push{{0, 10, false}},
+			want:   []byte{},
+		},
+		{
+			name:   "frames within the window are kept",
+			window: time.Second,
+			pushes: []push{{0, 10, true}, {500, 10, true}, {1000, 10, true}},
+			want:   []byte{0, 1, 2},
+		},
+		{
+			name:   "frames older than the window are evicted",
+			window: time.Second,
+			pushes: []push{{0, 10, true}, {400, 10, true}, {900, 10, true}, {1500, 10, true}},
+			want:   []byte{2, 3},
+		},
+		{
+			name:     "byte cap drops the oldest",
+			window:   time.Minute,
+			maxBytes: 25,
+			pushes:   []push{{0, 10, true}, {40, 10, true}, {80, 10, true}},
+			want:     []byte{1, 2},
+		},
+		{
+			name:     "frame above the byte cap is refused",
+			window:   time.Minute,
+			maxBytes: 25,
+			pushes:   []push{{0, 10, true}, {40, 30, false}},
+			want:     []byte{0},
+		},
+		{
+			name:      "global budget drops the oldest",
+			window:    time.Minute,
+			budgetMax: 30,
+			pushes:    []push{{0, 10, true}, {40, 10, true}, {80, 10, true}, {120, 15, true}},
+			want:      []byte{2, 3},
+		},
+		{
+			name:      "frame above the global budget is refused",
+			window:    time.Minute,
+			budgetMax: 30,
+			pushes:    []push{{0, 10, true}, {40, 40, false}},
+			want:      []byte{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			budget := NewByteBudget(test.budgetMax)
+			ring := newFrameRing(test.window, test.maxBytes, budget)
+			for i, p := range test.pushes {
+				if kept := ring.push(testFrame(byte(i), p.ms, p.size)); kept != p.kept {
+					t.Fatalf("push %d kept %v, want %v", i, kept, p.kept)
+				}
+			}
+			var bytes int64
+			for i := 0; i < ring.len(); i++ {
+				bytes += int64(len(ring.at(i).Data))
+			}
+			if ring.bytes != bytes || budget.used != bytes {
+				t.Fatalf("ring counts %d bytes, budget %d, frames hold %d", ring.bytes, budget.used, bytes)
+			}
+			if got := frameIds(ring.drain()); !slices.Equal(got, test.want) {
+				t.Fatalf("kept %v, want %v", got, test.want)
+			}
+			if budget.used != 0 {
+				t.Fatalf("%d bytes of the budget still used after drain", budget.used)
+			}
+		})
+	}
+}
+
+func TestFrameRingSharedBudget(t *testing.T) {
+	budget := NewByteBudget(30)
+	first := newFrameRing(time.Minute, 0, budget)
+	second := newFrameRing(time.Minute, 0, budget)
+
+	first.push(testFrame(0, 0, 10))
+	first.push(testFrame(1, 40, 10))
+	second.push(testFrame(2, 0, 10))
+	// the budget is spent, the second ring can only make room from its own frames
+	if !second.push(testFrame(3, 40, 10)) {
+		t.Fatal("second ring refused a frame it had room for")
+	}
+	if got := frameIds(second.drain()); !slices.Equal(got, []byte{3}) {
+		t.Fatalf("second ring kept %v, want [3]", got)
+	}
+	if first.len() != 2 {
+		t.Fatalf("first ring lost frames to the second, %d left", first.len())
+	}
+	empty := newFrameRing(time.Minute, 0, budget)
+	second.push(testFrame(4, 80, 10))
+	if empty.push(testFrame(5, 80, 10)) {
+		t.Fatal("ring without frames went over the budget")
+	}
+
+	first.clear()
+	if budget.used != 10 {
+		t.Fatalf("%d bytes used after clear, want 10 of the second ring", budget.used)
+	}
+	second.drain()
+	if budget.used != 0 {
+		t.Fatalf("%d bytes used after both rings let go", budget.used)
+	}
+	if !empty.push(testFrame(6, 120, 30)) {
+		t.Fatal("released budget not available again")
+	}
+}
+
+func TestFrameRingWrapsAround(t *testing.T) {
+	ring := newFrameRing(time.Second, 0, nil)
+	// 25 fps for 10s, the ring holds about a second of it at any time
+	for i := 0; i < 250; i++ {
+		ring.push(testFrame(byte(i), i*40, 1))
+	}
+	if len(ring.frames) > 4*minRingCapacity {
+		t.Fatalf("%d slots for %d frames", len(ring.frames), ring.len())
+	}
+	got := ring.drain()
+	if len(got) != 26 {
+		t.Fatalf("%d frames kept, want the 26 of the last second", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if !got[i].Timestamp.After(got[i-1].Timestamp) {
+			t.Fatalf("frame %d out of order", i)
+		}
+	}
+	if want := testStart.Add(249 * 40 * time.Millisecond); !got[len(got)-1].Timestamp.Equal(want) {
+		t.Fatalf("newest frame at %v, want %v", got[len(got)-1].Timestamp, want)
+	}
+	if len(ring.frames) != 0 {
+		t.Fatalf("drained ring keeps %d slots", len(ring.frames))
+	}
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/bootstrap"
+	"yolo-detector-service/export"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// RecordingsController serves the files of the archive
+type RecordingsController struct {
+	Env      *bootstrap.Env
+	Key      *archive.Key
+	Manifest *archive.Manifest
+}
+
+var ErrNoArchive = errors.New("no ARCHIVE_DIR configured, recordings are not served")
+
+// resolve turns the path of a request into a file below ARCHIVE_DIR, hidden
+// files and directories, e.g. the manifest, and RECORDINGS_TMP_DIR, where
+// recordings are written in plain, are never served
+func (rc *RecordingsController) resolve(name string) (string, error) {
+	if rc.Env.ARCHIVE_DIR == "" {
+		return "", ErrNoArchive
+	}
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "", os.ErrNotExist
+	}
+	for _, part := range strings.Split(name[1:], "/") {
+		if strings.HasPrefix(part, ".") {
+			return "", os.ErrNotExist
+		}
+	}
+	filePath := filepath.Join(rc.Env.ARCHIVE_DIR, filepath.FromSlash(name))
+	if tmp := rc.Env.RECORDINGS_TMP_DIR; tmp != "" && within(filePath, filepath.Clean(tmp)) {
+		return "", os.ErrNotExist
+	}
+	return filePath, nil
+}
+
+// within tells if path is dir or below it
+func within(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func failure(c *gin.Context, status int, err error) {
+	c.JSON(status, map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+	})
+}
+
+// Download sends a file of the archive, encrypted files are decrypted
+// on the way unless raw=true asks for the stored file
+func (rc *RecordingsController) Download(c *gin.Context) {
+	filePath, err := rc.resolve(c.Param("path"))
+	if err != nil {
+		failure(c, http.StatusNotFound, err)
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			failure(c, http.StatusNotFound, fmt.Errorf("no such recording"))
+		} else {
+			failure(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		failure(c, http.StatusNotFound, fmt.Errorf("no such recording"))
+		return
+	}
+	raw, _ := strconv.ParseBool(c.Query("raw"))
+	if raw || !archive.IsEncrypted(filePath) {
+		c.FileAttachment(filePath, filepath.Base(filePath))
+		return
+	}
+	if rc.Key == nil {
+		failure(c, http.StatusInternalServerError, fmt.Errorf("recording is encrypted and no key is configured"))
+		return
+	}
+	plain, err := archive.NewDecryptReader(file, rc.Key)
+	if err != nil {
+		failure(c, http.StatusInternalServerError, err)
+		return
+	}
+	name := strings.TrimSuffix(filepath.Base(filePath), archive.EncryptedExt)
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.FormatInt(archive.DecryptedSize(info.Size()), 10))
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, plain); err != nil {
+		// the status is sent already, the short body tells the client
+		logrus.Errorf("Failed to send decrypted %s: %v", filePath, err)
+		c.Abort()
+	}
+}
+
+// Verify checks the hash chains of the archive and the files they list,
+// ?camera= limits it to one camera, problems lists every mismatch
+func (rc *RecordingsController) Verify(c *gin.Context) {
+	report, err := rc.Manifest.Verify(c.Query("camera"))
+	if err != nil {
+		failure(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success": len(report.Problems) == 0,
+		"report":  report,
+	})
+}
+
+// Export cuts ?from= to ?to= of ?camera= out of the archive into one file,
+// times are RFC 3339, local 2006-01-02T15:04[:05] or 15:04[:05] of today
+func (rc *RecordingsController) Export(c *gin.Context) {
+	camera := c.Query("camera")
+	if camera == "" {
+		failure(c, http.StatusBadRequest, fmt.Errorf("camera is required"))
+		return
+	}
+	now := time.Now()
+	from, err := export.ParseTime(c.Query("from"), now)
+	if err != nil {
+		failure(c, http.StatusBadRequest, err)
+		return
+	}
+	to, err := export.ParseTime(c.Query("to"), now)
+	if err != nil {
+		failure(c, http.StatusBadRequest, err)
+		return
+	}
+	clip, err := export.New(rc.Env, rc.Key).Export(camera, from, to)
+	switch {
+	case errors.Is(err, export.ErrBadRange), errors.Is(err, export.ErrRangeTooLong):
+		failure(c, http.StatusBadRequest, err)
+		return
+	case errors.Is(err, export.ErrNoRecordings):
+		failure(c, http.StatusNotFound, err)
+		return
+	case errors.Is(err, export.ErrMixedFormats):
+		failure(c, http.StatusUnprocessableEntity, err)
+		return
+	case err != nil:
+		failure(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer os.Remove(clip.Path)
+	c.FileAttachment(clip.Path, clip.Name)
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/recorder"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+
+	// the event of timelapse recordings in sidecars and archive layouts
+	timelapseEvent     = "timelapse"
+	timelapseQueueSize = 4
+)
+
+// timelapse keeps one frame per TIMELAPSE_INTERVAL of a session whatever
+// its state, the frames are played back at TIMELAPSE_FPS and a new file
+// is started with every hour or day
+type timelapse struct {
+	session  *TrackerSession
+	interval time.Duration
+	period   string
+	step     time.Duration
+	layout   string
+	queue    *frameQueue
+	done     chan struct{}
+	// capture time of the last frame offered, under the session lock
+	lastTaken time.Time
+
+	// the open file, owned by run
+	recorder recorder.Recorder
+	key      string
+	count    int
+	firstAt  time.Time
+	lastAt   time.Time
+}
+
+// newTimelapse returns nil when TIMELAPSE_INTERVAL is off
+func newTimelapse(session *TrackerSession) *timelapse {
+	env := session.env
+	if env.TIMELAPSE_INTERVAL <= 0 {
+		return nil
+	}
+	period := env.TIMELAPSE_PERIOD
+	switch period {
+	case PeriodHour, PeriodDay:
+	case "":
+		period = PeriodHour
+	default:
+		logrus.Warnf("Unknown timelapse period %q, using %s", period, PeriodHour)
+		period = PeriodHour
+	}
+	fps := env.TIMELAPSE_FPS
+	if fps <= 0 {
+		fps = 25
+	}
+	layout := env.TIMELAPSE_LAYOUT
+	if layout == "" {
+		layout = archive.DefaultTimelapseLayout
+	}
+	return &timelapse{
+		session:  session,
+		interval: env.TIMELAPSE_INTERVAL,
+		period:   period,
+		step:     time.Second / time.Duration(fps),
+		layout:   layout,
+		// a slow encoder costs timelapse frames, never the stream
+		queue: newFrameQueue(timelapseQueueSize, DropOldest),
+		done:  make(chan struct{}),
+	}
+}
+
+// offer takes the frame if the interval has passed, called with the session lock held
+func (t *timelapse) offer(frame recorder.Frame) {
+	if t == nil {
+		return
+	}
+	if !t.lastTaken.IsZero() && frame.Timestamp.Sub(t.lastTaken) < t.interval {
+		return
+	}
+	t.lastTaken = frame.Timestamp
+	// detections belong to the clips, the timelapse is the plain picture
+	frame.Events = nil
+	t.queue.push(frame)
+}
+
+func (t *timelapse) start() {
+	if t == nil {
+		return
+	}
+	go t.run()
+}
+
+// close archives the open file once the queued frames are written
+func (t *timelapse) close() {
+	if t == nil {
+		return
+	}
+	t.queue.close()
+	<-t.done
+	if dropped := t.queue.dropped.Load(); dropped > 0 {
+		logrus.Warnf("[%s] Timelapse of session %d dropped %d frames", t.session.addr, t.session.sessionId, dropped)
+	}
+}
+
+func (t *timelapse) run() {
+	defer close(t.done)
+	for frame := range t.queue.frames {
+		t.write(frame)
+	}
+	t.finish()
+}
+
+func (t *timelapse) write(frame recorder.Frame) {
+	if t.session.disk.Low() {
+		// like the clips, nothing is written below the floor
+		t.finish()
+		return
+	}
+	key := t.periodKey(frame.Timestamp)
+	if t.recorder != nil && key != t.key {
+		t.finish()
+	}
+	if t.recorder != nil {
+		select {
+		case <-t.recorder.Done():
+			// ended on its own, the rest of the period goes into a new file
+			t.finish()
+		default:
+		}
+	}
+	if t.recorder == nil {
+		if err := t.open(key); err != nil {
+			logrus.Errorf("[%s] Failed to start timelapse: %v", t.session.addr, err)
+			return
+		}
+		t.firstAt = frame.Timestamp
+	}
+	t.lastAt = frame.Timestamp
+	// retimed to the playback rate, the sidecar keeps the capture times
+	frame.Timestamp = t.firstAt.Add(time.Duration(t.recorder.Info().Frames) * t.step)
+	if err := t.recorder.WriteFrame(frame); err != nil {
+		logrus.Errorf("[%s] Failed to write timelapse frame: %v", t.session.addr, err)
+	}
+}
+
+func (t *timelapse) periodKey(at time.Time) string {
+	if t.period == PeriodDay {
+		return at.Local().Format("20060102")
+	}
+	return at.Local().Format("2006010215")
+}
+
+func (t *timelapse) open(key string) error {
+	s := t.session
+	t.count += 1
+	fileName := fmt.Sprintf("session_%04d_%s_%s_%02d", s.sessionId, timelapseEvent, key, t.count)
+	rec := recorder.New(s.env)
+	if err := rec.Start(path.Join(s.env.RECORDINGS_TMP_DIR, fileName)); err != nil {
+		return err
+	}
+	t.recorder = rec
+	t.key = key
+	return nil
+}
+
+// finish stops the open file and moves it to the archive with its sidecar
+func (t *timelapse) finish() {
+	if t.recorder == nil {
+		return
+	}
+	rec := t.recorder
+	t.recorder = nil
+	if err := rec.Stop(); err != nil {
+		logrus.Printf("Timelapse recorder exited with error: %v", err)
+	}
+	info := rec.Info()
+	logrus.Printf("Timelapse %s finished [%s], frames: %d, bytes: %d", t.key, info.Path, info.Frames, info.Bytes)
+	if info.Frames == 0 || info.Backend == recorder.BackendNoop {
+		return
+	}
+	s := t.session
+	entry := archive.Entry{
+		Camera:  s.camera,
+		Session: s.sessionId,
+		Event:   timelapseEvent,
+		Segment: t.count,
+		Start:   t.firstAt,
+		Path:    info.Path,
+	}
+	sidecar := &archive.Sidecar{
+		SessionId: s.sessionId,
+		Peer:      s.addr,
+		Camera:    s.camera,
+		Event:     timelapseEvent,
+		Segment:   t.count,
+		Backend:   info.Backend,
+		StartedAt: t.firstAt,
+		EndedAt:   t.lastAt,
+		Frames:    info.Frames,
+		Truncated: info.Truncated,
+		Classes:   []string{},
+	}
+	target, err := archive.TargetIn(s.env, entry, t.layout)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+	}
+	if err != nil {
+		logrus.Errorf("Failed to archive %s: %v", entry.Path, err)
+		return
+	}
+	stored := []string{archive.StoredPath(target, s.key)}
+	if path, err := archive.WriteSidecar(target, sidecar, s.key); err != nil {
+		logrus.Errorf("Failed to write sidecar of %s: %v", target, err)
+	} else {
+		stored = append(stored, path)
+	}
+	if err := archive.Finalize(entry, target, s.key); err != nil {
+		logrus.Errorf("Failed to archive %s: %v", entry.Path, err)
+		return
+	}
+	if err := s.manifest.Add(s.camera, stored); err != nil {
+		logrus.Errorf("Failed to add %s to the manifest: %v", target, err)
+	}
+	logrus.Printf("Timelapse archived [%s]", stored[0])
+}
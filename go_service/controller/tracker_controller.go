@@ -1,20 +1,37 @@
 package controller
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"yolo-detector-service/archive"
 	"yolo-detector-service/bootstrap"
 	pb "yolo-detector-service/grpc/generated"
+	"yolo-detector-service/overlay"
+	"yolo-detector-service/recorder"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v4"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 )
 
 type TrackerServer struct {
 	Env            *bootstrap.Env
 	Trackers       map[string]*TrackerSession
+	PreRollBudget  *ByteBudget
+	DiskGuard      *DiskGuard
+	Key            *archive.Key
+	Manifest       *archive.Manifest
+	Markers        *archive.MarkerIndex
 	lock           sync.Mutex
 	sessionCounter int
 	// Required to be embedded for forward compatibility
@@ -36,14 +53,38 @@ func (s *TrackerServer) StreamUpdates(stream pb.TrackerService_StreamUpdatesServ
 		return nil
 	}
 	s.sessionCounter = s.sessionCounter + 1
+	camera := cameraId(stream.Context(), addr)
+	mode := recordingMode(stream.Context(), s.Env, camera)
+	preRoll := s.Env.PRE_ROLL
+	if mode == ModeSnapshot || mode == ModeDvr {
+		// the still is the frame at the moment the target was confirmed,
+		// DVR records anyway
+		preRoll = 0
+	}
 	session = &TrackerSession{
 		doneChan:  make(chan struct{}),
 		sessionId: s.sessionCounter,
+		camera:    camera,
+		mode:      mode,
 		env:       s.Env,
+		disk:      s.DiskGuard,
+		key:       s.Key,
+		manifest:  s.Manifest,
+		markers:   s.Markers,
+		queue:     newFrameQueue(s.Env.FRAME_QUEUE_SIZE, s.Env.FRAME_QUEUE_DROP_POLICY),
+		viewers:   newMjpegHub(),
 		trackerTime: TrackerTime{
-			env: s.Env,
+			env:     s.Env,
+			preRoll: newFrameRing(preRoll, s.Env.PRE_ROLL_MAX_BYTES, s.PreRollBudget),
 		},
 	}
+	logrus.Printf("[%s] Session %d of camera %s records %s", addr, session.sessionId, camera, mode)
+	if s.Env.OVERLAY_ENABLED {
+		session.overlay = overlay.New(s.Env)
+	}
+	session.timelapse = newTimelapse(session)
+	session.live = newLiveStream(session)
+	session.webrtc = newWebrtcStream(session)
 	s.Trackers[addr] = session
 	s.lock.Unlock()
 	defer func() {
@@ -57,6 +98,321 @@ func (s *TrackerServer) StreamUpdates(stream pb.TrackerService_StreamUpdatesServ
 
 }
 
+// cameraId is sent by the detector in the camera-id metadata,
+// older detectors are told apart by their host
+func cameraId(ctx context.Context, addr string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("camera-id"); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+type sessionStatus struct {
+	SessionId     int    `json:"session_id"`
+	Peer          string `json:"peer"`
+	Camera        string `json:"camera"`
+	State         string `json:"state"`
+	Mode          string `json:"mode"`
+	Recording     string `json:"recording,omitempty"`
+	Event         string `json:"event,omitempty"`
+	DroppedFrames int64  `json:"dropped_frames"`
+	Live          bool   `json:"live"`
+	MjpegViewers  int    `json:"mjpeg_viewers"`
+	WebrtcViewers int    `json:"webrtc_viewers"`
+}
+
+// Status lists the sessions and the disk alert, a session in
+// disk_full state is not recording because of low free space
+func (cc *TrackerServer) Status(c *gin.Context) {
+	cc.lock.Lock()
+	sessions := make([]*TrackerSession, 0, len(cc.Trackers))
+	for _, session := range cc.Trackers {
+		sessions = append(sessions, session)
+	}
+	cc.lock.Unlock()
+
+	statuses := make([]sessionStatus, 0, len(sessions))
+	alert := false
+	for _, session := range sessions {
+		session.lock.Lock()
+		status := sessionStatus{
+			SessionId:     session.sessionId,
+			Peer:          session.addr,
+			Camera:        session.camera,
+			State:         session.state.String(),
+			Mode:          session.mode,
+			DroppedFrames: session.queue.dropped.Load(),
+			Live:          session.live != nil && session.live.watched(),
+			MjpegViewers:  session.viewers.count(),
+			WebrtcViewers: session.webrtc.count(),
+		}
+		if session.recording != nil {
+			status.Recording = session.recording.id
+		}
+		if session.openEvent != nil {
+			status.Event = session.openEvent.Event
+		}
+		alert = alert || session.state == StateDiskFull
+		session.lock.Unlock()
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b sessionStatus) int {
+		return a.SessionId - b.SessionId
+	})
+	disk := cc.DiskGuard.Status()
+	c.JSON(http.StatusOK, gin.H{
+		"alert":    alert || disk.Low,
+		"disk":     disk,
+		"sessions": statuses,
+	})
+}
+
+// Live serves the HLS playlist of a session and its segments,
+// the first request of the playlist starts the encoder
+func (cc *TrackerServer) Live(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	session := cc.session(id)
+	if err != nil || session == nil {
+		failure(c, http.StatusNotFound, errors.New("no such session"))
+		return
+	}
+	if session.live == nil {
+		failure(c, http.StatusNotFound, errors.New("live view is disabled"))
+		return
+	}
+	c.Header("Cache-Control", "no-cache")
+	file := c.Param("file")
+	if file == livePlaylist {
+		playlist, err := session.live.watch(3*cc.Env.LIVE_SEGMENT_DURATION + 5*time.Second)
+		if err != nil {
+			failure(c, http.StatusServiceUnavailable, err)
+			return
+		}
+		c.Header("Content-Type", "application/vnd.apple.mpegurl")
+		c.File(playlist)
+		return
+	}
+	segment, err := session.live.segment(file)
+	if err != nil {
+		failure(c, http.StatusNotFound, errors.New("no such segment"))
+		return
+	}
+	c.Header("Content-Type", "video/mp2t")
+	c.File(segment)
+}
+
+// Mjpeg streams the frames of a session as they arrive as multipart/x-mixed-replace,
+// nothing is encoded, a browser shows it in an img tag
+func (cc *TrackerServer) Mjpeg(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	session := cc.session(id)
+	if err != nil || session == nil {
+		failure(c, http.StatusNotFound, errors.New("no such session"))
+		return
+	}
+	viewer := session.viewers.subscribe()
+	if viewer == nil {
+		failure(c, http.StatusNotFound, errors.New("no such session"))
+		return
+	}
+	logrus.Printf("[%s] MJPEG viewer %s joined session %d", session.addr, c.ClientIP(), id)
+	defer func() {
+		dropped := session.viewers.unsubscribe(viewer)
+		logrus.Printf("[%s] MJPEG viewer %s left session %d, frames dropped: %d", session.addr, c.ClientIP(), id, dropped)
+	}()
+
+	c.Header("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	writer := http.NewResponseController(c.Writer)
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case frame, ok := <-viewer.frames:
+			if !ok {
+				// the session ended
+				return
+			}
+			// a viewer that stops reading is dropped instead of hanging around
+			writer.SetWriteDeadline(time.Now().Add(mjpegWriteTimeout))
+			_, err := fmt.Fprintf(c.Writer, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+				mjpegBoundary, len(frame))
+			if err == nil {
+				_, err = c.Writer.Write(frame)
+			}
+			if err == nil {
+				_, err = c.Writer.WriteString("\r\n")
+			}
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Webrtc answers the offer of a browser with the VP8 track of a session,
+// a data channel the browser opens as "events" gets the detections of every frame
+func (cc *TrackerServer) Webrtc(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	session := cc.session(id)
+	if err != nil || session == nil {
+		failure(c, http.StatusNotFound, errors.New("no such session"))
+		return
+	}
+	if session.webrtc == nil {
+		failure(c, http.StatusNotFound, errors.New("WebRTC view is disabled"))
+		return
+	}
+	var offer webrtc.SessionDescription
+	if err := c.ShouldBindJSON(&offer); err != nil {
+		failure(c, http.StatusBadRequest, err)
+		return
+	}
+	if offer.Type != webrtc.SDPTypeOffer || offer.SDP == "" {
+		failure(c, http.StatusBadRequest, errors.New("expected an offer with its sdp"))
+		return
+	}
+	answer, err := session.webrtc.answer(offer)
+	if errors.Is(err, ErrWebrtcClosed) {
+		failure(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		failure(c, http.StatusServiceUnavailable, err)
+		return
+	}
+	c.JSON(http.StatusOK, answer)
+}
+
+// AllowBrowsers lets pages of the CORS_ALLOWED_ORIGINS watch and signal,
+// the viewer UI is not served from here. Other origins get no CORS headers,
+// browsers then keep them to same-origin requests
+func AllowBrowsers(env *bootstrap.Env) gin.HandlerFunc {
+	anyOrigin := slices.Contains(env.CORS_ALLOWED_ORIGINS, "*")
+	return func(c *gin.Context) {
+		c.Header("Vary", "Origin")
+		origin := c.GetHeader("Origin")
+		if origin != "" && (anyOrigin || slices.Contains(env.CORS_ALLOWED_ORIGINS, origin)) {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Content-Type")
+		}
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Snapshot sends the latest frame of a session, ?overlay=true draws the detections on it
+func (cc *TrackerServer) Snapshot(c *gin.Context) {
+	session, frame, ok := cc.latestFrame(c)
+	if !ok {
+		return
+	}
+	data := frame.Data
+	if draw, _ := strconv.ParseBool(c.Query("overlay")); draw && len(frame.Events) > 0 {
+		renderer := session.overlay
+		if renderer == nil {
+			renderer = overlay.New(cc.Env)
+		}
+		drawn, err := renderer.Draw(frame.Data, frame.Events)
+		if err != nil {
+			failure(c, http.StatusInternalServerError, err)
+			return
+		}
+		data = drawn
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Last-Modified", frame.Timestamp.UTC().Format(http.TimeFormat))
+	c.Data(http.StatusOK, "image/jpeg", data)
+}
+
+// SnapshotEvents returns the detections of the latest frame of a session
+func (cc *TrackerServer) SnapshotEvents(c *gin.Context) {
+	session, frame, ok := cc.latestFrame(c)
+	if !ok {
+		return
+	}
+	events := make([]archive.TrackEvent, 0, len(frame.Events))
+	for _, event := range frame.Events {
+		events = append(events, archive.NewTrackEvent(event, frame.Timestamp))
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"session_id": session.sessionId,
+		"camera":     session.camera,
+		"timestamp":  frame.Timestamp,
+		"events":     events,
+	})
+}
+
+// latestFrame answers the request itself when there is no frame to return
+func (cc *TrackerServer) latestFrame(c *gin.Context) (*TrackerSession, recorder.Frame, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	session := cc.session(id)
+	if err != nil || session == nil {
+		failure(c, http.StatusNotFound, errors.New("no such session"))
+		return nil, recorder.Frame{}, false
+	}
+	session.lock.Lock()
+	frame := session.latest
+	session.lock.Unlock()
+	if len(frame.Data) == 0 {
+		failure(c, http.StatusNotFound, errors.New("no frame received yet"))
+		return nil, recorder.Frame{}, false
+	}
+	return session, frame, true
+}
+
+func (cc *TrackerServer) session(id int) *TrackerSession {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	for _, session := range cc.Trackers {
+		if session.sessionId == id {
+			return session
+		}
+	}
+	return nil
+}
+
+// recordingMode is asked for by the detector in the recording-mode metadata,
+// otherwise it comes from RECORDING_MODE_CAMERAS and RECORDING_MODE
+func recordingMode(ctx context.Context, env *bootstrap.Env, camera string) string {
+	mode := env.RECORDING_MODE
+	for _, item := range env.RECORDING_MODE_CAMERAS {
+		if name, value, ok := strings.Cut(item, ":"); ok && strings.TrimSpace(name) == camera {
+			mode = strings.TrimSpace(value)
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("recording-mode"); len(values) > 0 && values[0] != "" {
+			mode = values[0]
+		}
+	}
+	switch mode {
+	case ModeVideo, ModeSnapshot, ModeDvr:
+		return mode
+	case "":
+		return ModeVideo
+	default:
+		logrus.Warnf("Unknown recording mode %q of camera %s, using %s", mode, camera, ModeVideo)
+		return ModeVideo
+	}
+}
+
 func (cc *TrackerServer) TestMethod(c *gin.Context) {
 	response := map[string]interface{}{
 		"success": true,
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"yolo-detector-service/bootstrap"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAllowBrowsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name    string
+		allowed []string
+		method  string
+		origin  string
+		// Access-Control-Allow-Origin, empty for none
+		wantOrigin string
+		wantStatus int
+	}{
+		{
+			name:       "same origin by default",
+			method:     http.MethodGet,
+			origin:     "https://viewer.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "allowed origin",
+			allowed:    []string{"https://other.example.com", "https://viewer.example.com"},
+			method:     http.MethodGet,
+			origin:     "https://viewer.example.com",
+			wantOrigin: "https://viewer.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "origin not in the list",
+			allowed:    []string{"https://viewer.example.com"},
+			method:     http.MethodGet,
+			origin:     "https://evil.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "request without origin",
+			allowed:    []string{"https://viewer.example.com"},
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "any origin",
+			allowed:    []string{"*"},
+			method:     http.MethodGet,
+			origin:     "https://viewer.example.com",
+			wantOrigin: "https://viewer.example.com",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "preflight of an allowed origin",
+			allowed:    []string{"https://viewer.example.com"},
+			method:     http.MethodOptions,
+			origin:     "https://viewer.example.com",
+			wantOrigin: "https://viewer.example.com",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "preflight of another origin",
+			allowed:    []string{"https://viewer.example.com"},
+			method:     http.MethodOptions,
+			origin:     "https://evil.example.com",
+			wantStatus: http.StatusNoContent,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(AllowBrowsers(&bootstrap.Env{CORS_ALLOWED_ORIGINS: test.allowed}))
+			router.Handle(test.method, "/v1/sessions/:id/mjpeg", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(test.method, "/v1/sessions/1/mjpeg", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != test.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, test.wantStatus)
+			}
+			if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != test.wantOrigin {
+				t.Errorf("allowed origin %q, want %q", origin, test.wantOrigin)
+			}
+			if methods := w.Header().Get("Access-Control-Allow-Methods"); (methods != "") != (test.wantOrigin != "") {
+				t.Errorf("allowed methods %q sent to origin %q", methods, test.origin)
+			}
+			if vary := w.Header().Get("Vary"); vary != "Origin" {
+				t.Errorf("vary %q, want Origin", vary)
+			}
+		})
+	}
+}
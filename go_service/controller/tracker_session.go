@@ -2,11 +2,13 @@ package controller
 
 import (
 	"io"
-	"os/exec"
 	"sync"
 	"time"
+	"yolo-detector-service/archive"
 	"yolo-detector-service/bootstrap"
 	pb "yolo-detector-service/grpc/generated"
+	"yolo-detector-service/overlay"
+	"yolo-detector-service/recorder"
 
 	"github.com/sirupsen/logrus"
 )
@@ -17,58 +19,97 @@ const (
 	StateIdle TrackerState = iota
 	StateRun
 	StateCanceled
+	// not recording until there is free space again
+	StateDiskFull
 )
 
+const (
+	ModeVideo = "video"
+	// a still every SNAPSHOT_INTERVAL instead of a video
+	ModeSnapshot = "snapshot"
+	// always recording, detections set markers in the DVR index
+	ModeDvr = "dvr"
+)
+
+func (s TrackerState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateRun:
+		return "run"
+	case StateCanceled:
+		return "canceled"
+	case StateDiskFull:
+		return "disk_full"
+	}
+	return "unknown"
+}
+
 type TrackerSession struct {
 	sessionId     int
+	addr          string
+	camera        string
+	mode          string
 	state         TrackerState
 	timer         *time.Ticker
 	streamStarted time.Time
 	trackerTime   TrackerTime
 	recordCount   int
 	doneChan      chan struct{}
-	gstCmd        *exec.Cmd
-	gstIn         io.WriteCloser
+	finalizing    sync.WaitGroup
+	queue         *frameQueue
+	writing       sync.WaitGroup
+	reportedDrops int64
+	recorder      recorder.Recorder
+	recording     *recording
+	timelapse     *timelapse
+	live          *liveStream
+	viewers       *mjpegHub
+	webrtc        *webrtcStream
+	latest        recorder.Frame
+	markers       *archive.MarkerIndex
+	openEvent     *archive.Marker
+	eventCount    int
+	overlay       *overlay.Renderer
+	disk          *DiskGuard
+	key           *archive.Key
+	manifest      *archive.Manifest
 	env           *bootstrap.Env
 	lock          sync.Mutex
 }
 
 type TrackerTime struct {
-	firstEvent    *pb.TrackEvent
-	lastEvent     *pb.TrackEvent
-	env           *bootstrap.Env
-	preRecordBuff [][]byte
+	firstEvent *pb.TrackEvent
+	lastEvent  *pb.TrackEvent
+	env        *bootstrap.Env
+	preRoll    *frameRing
+	// capture clock minus receive time, measured on the last event
+	clockOffset time.Duration
 }
 
 func (cc *TrackerSession) startSession(addr string, stream pb.TrackerService_StreamUpdatesServer) error {
+	cc.addr = addr
 	cc.state = StateIdle
 	cc.streamStarted = time.Now()
 	cc.timer = time.NewTicker(cc.env.SESSION_TASK_TIMER)
+	cc.writing.Add(1)
+	go cc.runWriter()
+	cc.timelapse.start()
+	cc.live.start()
+	cc.webrtc.start()
+	if cc.mode == ModeDvr {
+		// the recording does not wait for the first tick
+		cc.lock.Lock()
+		cc.keepRecording()
+		cc.lock.Unlock()
+	}
 	go func() {
 		for {
 			select {
 			case <-cc.timer.C:
 				logrus.Printf("[%s] Session timer ticked.", addr)
-				switch cc.state {
-				case StateIdle:
-					cc.lock.Lock()
-					if cc.trackerTime.hasTargetFor(cc.env.TARGET_THRESHOLD_DURATION) {
-						cc.trackerTime.clear()
-						cc.startPipeline()
-						cc.state = StateRun
-					}
-					cc.lock.Unlock()
-				case StateRun:
-					cc.lock.Lock()
-					if cc.trackerTime.noTargetFor(cc.env.TARGET_THRESHOLD_DURATION) {
-						cc.trackerTime.clear()
-						cc.stopPipeline()
-						cc.state = StateIdle
-					}
-					cc.lock.Unlock()
-				case StateCanceled:
-					break
-				}
+				cc.live.tick()
+				cc.tick()
 			case <-cc.doneChan:
 				logrus.Printf("[%s] Session cleanup signal received. Stopping ticker.", addr)
 				return
@@ -91,34 +132,127 @@ func (cc *TrackerSession) startSession(addr string, stream pb.TrackerService_Str
 	}
 }
 
+// tick moves the session along its states, run by the session timer
+func (cc *TrackerSession) tick() {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if cc.mode == ModeDvr {
+		cc.dvrTick()
+		return
+	}
+	addr := cc.addr
+	switch cc.state {
+	case StateIdle:
+		if cc.trackerTime.noTargetFor(cc.env.ARM_DELAY) {
+			// the target left before the recording was armed,
+			// however long ago it first appeared
+			cc.trackerTime.clear()
+		} else if cc.trackerTime.hasTargetFor(cc.env.ARM_DELAY) && cc.disk.Check() {
+			logrus.Errorf("[%s] Not recording, disk space is below the floor", addr)
+			cc.trackerTime.firstEvent = nil
+			cc.state = StateDiskFull
+		} else if cc.trackerTime.hasTargetFor(cc.env.ARM_DELAY) {
+			trigger := cc.trackerTime.firstEvent.GetClassName()
+			// lastEvent is kept, the post-roll counts from it
+			cc.trackerTime.firstEvent = nil
+			if err := cc.startPipeline(trigger); err != nil {
+				logrus.Errorf("[%s] Failed to start recording: %v", addr, err)
+			} else {
+				cc.state = StateRun
+			}
+		}
+	case StateRun:
+		cc.reportDrops()
+		if cc.trackerTime.noTargetFor(cc.env.POST_ROLL) {
+			cc.trackerTime.clear()
+			// new frames go to the pre-roll while the tail is written
+			cc.state = StateIdle
+			cc.closePipeline()
+		} else if cc.disk.Low() {
+			logrus.Errorf("[%s] Disk space is below the floor, closing the recording", addr)
+			cc.state = StateDiskFull
+			cc.closePipeline()
+		} else if cc.recorder == nil {
+			// the previous recorder died, continue the event in a new segment
+			if err := cc.startSegment(); err != nil {
+				logrus.Errorf("[%s] Failed to restart recording: %v", addr, err)
+			}
+		}
+	case StateDiskFull:
+		if !cc.disk.Low() {
+			cc.state = StateIdle
+		} else if cc.trackerTime.noTargetFor(cc.env.ARM_DELAY) {
+			cc.trackerTime.clear()
+		}
+	}
+}
+
 func (cc *TrackerSession) closeSession() {
-	logrus.Println("Stopping GStreamer...")
+	logrus.Println("Stopping recorder...")
 	close(cc.doneChan)
+	// the frames already received still go into the recording
+	cc.queue.close()
+	cc.writing.Wait()
+	cc.timelapse.close()
+	cc.live.close()
+	cc.webrtc.close()
+	cc.viewers.close()
+	if dropped := cc.queue.dropped.Load(); dropped > 0 {
+		logrus.Warnf("[%s] Session %d dropped %d frames, the recorder could not keep up", cc.addr, cc.sessionId, dropped)
+	}
+	cc.lock.Lock()
+	cc.endEvent(eventTime(cc.trackerTime.lastEvent))
 	cc.stopPipeline()
+	cc.trackerTime.preRoll.clear()
+	cc.lock.Unlock()
+	cc.finalizing.Wait()
 }
 
 func (c *TrackerTime) updateTime(events []*pb.TrackEvent) {
-	hasTarget := c.containsAllowedClass(events)
-	if hasTarget {
+	target := c.lastAllowedEvent(events)
+	if target != nil {
 		if c.firstEvent == nil {
-			c.firstEvent = events[len(events)-1]
+			c.firstEvent = target
 		}
-		c.lastEvent = events[len(events)-1]
+		c.lastEvent = target
 	}
 }
 
+// captureTime is when the detector took the frame, events carry it,
+// frames without events are placed with the last known clock offset
+func (c *TrackerTime) captureTime(events []*pb.TrackEvent, received time.Time) time.Time {
+	var latest int64
+	for _, event := range events {
+		if event.GetTimestampMs() > latest {
+			latest = event.GetTimestampMs()
+		}
+	}
+	if latest == 0 {
+		return received.Add(c.clockOffset)
+	}
+	captured := time.UnixMilli(latest)
+	c.clockOffset = captured.Sub(received)
+	return captured
+}
+
 func (c *TrackerTime) clear() {
 	c.firstEvent = nil
 	c.lastEvent = nil
 }
 
-func (cc *TrackerTime) containsAllowedClass(events []*pb.TrackEvent) bool {
-	classes := cc.env.SESSION_ALLOWED_CLASSES
-	for _, event := range events {
-		for _, name := range classes {
-			if name == *event.ClassName {
-				return true
-			}
+func (cc *TrackerTime) lastAllowedEvent(events []*pb.TrackEvent) *pb.TrackEvent {
+	for i := len(events) - 1; i >= 0; i-- {
+		if cc.isAllowedClass(events[i].GetClassName()) {
+			return events[i]
+		}
+	}
+	return nil
+}
+
+func (cc *TrackerTime) isAllowedClass(className string) bool {
+	for _, name := range cc.env.SESSION_ALLOWED_CLASSES {
+		if name == className {
+			return true
 		}
 	}
 	return false
@@ -145,36 +279,48 @@ func (cc *TrackerTime) noTargetFor(duration time.Duration) bool {
 }
 
 func (cc *TrackerSession) processUpdate(update *pb.FrameUpdate) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
 	cc.trackerTime.updateTime(update.Events)
 
 	if len(update.EncodedFrame) > 0 {
-		switch cc.state {
-		case StateIdle:
-			maxPreRoll := 150
-			cc.trackerTime.preRecordBuff = append(cc.trackerTime.preRecordBuff, update.EncodedFrame)
-			if len(cc.trackerTime.preRecordBuff) > maxPreRoll {
-				cc.trackerTime.preRecordBuff = cc.trackerTime.preRecordBuff[1:]
+		frame := recorder.Frame{
+			Data:      update.EncodedFrame,
+			Timestamp: cc.trackerTime.captureTime(update.Events, time.Now()),
+			Events:    update.Events,
+		}
+		cc.latest = frame
+		cc.timelapse.offer(frame)
+		cc.live.offer(frame)
+		cc.webrtc.offer(frame)
+		cc.viewers.broadcast(frame.Data)
+		if cc.mode == ModeDvr {
+			// recorded whatever the state, paused only while the disk is full
+			if cc.recorder != nil && !cc.recording.closing {
+				cc.queue.push(frame)
 			}
+			return
+		}
+		switch cc.state {
+		case StateIdle, StateDiskFull:
+			cc.trackerTime.bufferFrame(frame)
 		case StateRun:
-			if len(cc.trackerTime.preRecordBuff) > 0 {
-				for _, i := range cc.trackerTime.preRecordBuff {
-					cc.writeFrame(i)
-				}
-				cc.trackerTime.preRecordBuff = [][]byte{}
+			if cc.recorder == nil {
+				// keep frames until the restarted recorder picks them up
+				cc.trackerTime.bufferFrame(frame)
+				break
 			}
-			cc.writeFrame(update.EncodedFrame)
+			cc.queue.push(frame)
 		}
 	}
 }
 
-func (cc *TrackerSession) writeFrame(frame []byte) error {
-	n, err := cc.gstIn.Write(frame)
-	if err != nil {
-		logrus.Errorf("Error writing frame to GStreamer stdin: %v", err)
-		return err
+func (cc *TrackerTime) bufferFrame(frame recorder.Frame) {
+	if cc.preRoll.window <= 0 {
+		// pre-roll is off
+		return
 	}
-	if n != len(frame) {
-		logrus.Warnf("Incomplete write to GStreamer: Wrote %d of %d bytes", n, len(frame))
+	if !cc.preRoll.push(frame) {
+		logrus.Debugf("Pre-roll frame of %d bytes dropped, buffer limit reached", len(frame.Data))
 	}
-	return nil
 }
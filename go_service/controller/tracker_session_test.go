@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"math"
+	"testing"
+	"time"
+	"yolo-detector-service/bootstrap"
+	pb "yolo-detector-service/grpc/generated"
+	"yolo-detector-service/recorder"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testArmDelay = 3 * time.Second
+	testPostRoll = 10 * time.Second
+)
+
+func newTestSession(t *testing.T, diskLow bool) *TrackerSession {
+	t.Helper()
+	env := &bootstrap.Env{
+		RECORDER_BACKEND:        recorder.BackendNoop,
+		RECORDINGS_TMP_DIR:      t.TempDir(),
+		ARM_DELAY:               testArmDelay,
+		POST_ROLL:               testPostRoll,
+		SESSION_ALLOWED_CLASSES: []string{"person"},
+		FRAME_QUEUE_SIZE:        8,
+	}
+	if diskLow {
+		// more than any volume has
+		env.DISK_MIN_FREE_BYTES = math.MaxInt64
+	}
+	return &TrackerSession{
+		addr:     "test",
+		mode:     ModeVideo,
+		state:    StateIdle,
+		env:      env,
+		disk:     NewDiskGuard(env),
+		queue:    newFrameQueue(env.FRAME_QUEUE_SIZE, DropOldest),
+		doneChan: make(chan struct{}),
+		trackerTime: TrackerTime{
+			env:     env,
+			preRoll: newFrameRing(0, 0, nil),
+		},
+	}
+}
+
+// seenAgo is a detection of a person made ago, nil for ago 0
+func seenAgo(ago time.Duration) *pb.TrackEvent {
+	if ago == 0 {
+		return nil
+	}
+	return &pb.TrackEvent{
+		ClassName:   proto.String("person"),
+		TimestampMs: proto.Int64(time.Now().Add(-ago).UnixMilli()),
+	}
+}
+
+func TestSessionTick(t *testing.T) {
+	tests := []struct {
+		name string
+		// session before the tick
+		state     TrackerState
+		recording bool
+		// the recorder of the open segment ended on its own
+		recorderDied bool
+		firstAgo     time.Duration
+		lastAgo      time.Duration
+		diskLow      bool
+		// session after the tick
+		wantState     TrackerState
+		wantRecording bool
+		wantSegments  int
+		// the first detection is kept to arm the recording
+		wantArming bool
+		wantTarget bool
+	}{
+		{
+			name:     "target not there for the arm delay yet",
+			state:    StateIdle,
+			firstAgo: time.Second, lastAgo: time.Second,
+			wantState: StateIdle, wantArming: true, wantTarget: true,
+		},
+		{
+			name:     "target there for the arm delay",
+			state:    StateIdle,
+			firstAgo: testArmDelay + time.Second, lastAgo: time.Second,
+			wantState: StateRun, wantRecording: true, wantSegments: 1, wantTarget: true,
+		},
+		{
+			name:      "target left before the arm delay",
+			state:     StateIdle,
+			lastAgo:   testArmDelay + time.Second,
+			wantState: StateIdle,
+		},
+		{
+			name:     "target seen once and gone for the arm delay",
+			state:    StateIdle,
+			firstAgo: testArmDelay + time.Second, lastAgo: testArmDelay + time.Second,
+			wantState: StateIdle,
+		},
+		{
+			name:     "target there for the arm delay on a full disk",
+			state:    StateIdle,
+			firstAgo: testArmDelay + time.Second, lastAgo: time.Second,
+			diskLow:   true,
+			wantState: StateDiskFull, wantTarget: true,
+		},
+		{
+			name:      "target gone within the post-roll",
+			state:     StateRun,
+			recording: true,
+			lastAgo:   testPostRoll - time.Second,
+			wantState: StateRun, wantRecording: true, wantSegments: 1, wantTarget: true,
+		},
+		{
+			name:      "target gone for the post-roll",
+			state:     StateRun,
+			recording: true,
+			lastAgo:   testPostRoll + time.Second,
+			wantState: StateIdle,
+		},
+		{
+			name:      "disk full while recording",
+			state:     StateRun,
+			recording: true,
+			lastAgo:   time.Second,
+			diskLow:   true,
+			wantState: StateDiskFull, wantTarget: true,
+		},
+		{
+			name:         "recorder ended while recording",
+			state:        StateRun,
+			recording:    true,
+			recorderDied: true,
+			lastAgo:      time.Second,
+			wantState:    StateRun, wantRecording: true, wantSegments: 2, wantTarget: true,
+		},
+		{
+			name:      "disk space recovered",
+			state:     StateDiskFull,
+			lastAgo:   time.Second,
+			wantState: StateIdle, wantTarget: true,
+		},
+		{
+			name:      "disk still full, target gone",
+			state:     StateDiskFull,
+			lastAgo:   testArmDelay + time.Second,
+			diskLow:   true,
+			wantState: StateDiskFull,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestSession(t, test.diskLow)
+			if test.recording {
+				if err := s.startPipeline("person"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.recorderDied {
+				killRecorder(t, s)
+			}
+			s.state = test.state
+			s.trackerTime.firstEvent = seenAgo(test.firstAgo)
+			s.trackerTime.lastEvent = seenAgo(test.lastAgo)
+
+			s.tick()
+
+			s.lock.Lock()
+			if s.state != test.wantState {
+				t.Errorf("state %s, want %s", s.state, test.wantState)
+			}
+			if recording := s.recording != nil && s.recorder != nil; recording != test.wantRecording {
+				t.Errorf("recording %v, want %v", recording, test.wantRecording)
+			}
+			if test.wantRecording && s.recording.segments != test.wantSegments {
+				t.Errorf("%d segments, want %d", s.recording.segments, test.wantSegments)
+			}
+			if arming := s.trackerTime.firstEvent != nil; arming != test.wantArming {
+				t.Errorf("arming %v, want %v", arming, test.wantArming)
+			}
+			if target := s.trackerTime.lastEvent != nil; target != test.wantTarget {
+				t.Errorf("target kept %v, want %v", target, test.wantTarget)
+			}
+			s.stopPipeline()
+			s.lock.Unlock()
+			s.finalizing.Wait()
+		})
+	}
+}
+
+// killRecorder ends the open segment the way a crashed encoder does
+func killRecorder(t *testing.T, s *TrackerSession) {
+	t.Helper()
+	if err := s.recorder.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.lock.Lock()
+		stopped := s.recorder == nil
+		s.lock.Unlock()
+		if stopped {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("recorder end not noticed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
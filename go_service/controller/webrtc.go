@@ -0,0 +1,376 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/recorder"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/ivfreader"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// a short queue, late frames are worth less than lost ones
+	webrtcQueueSize        = 4
+	webrtcKeyframeInterval = 2 * time.Second
+	webrtcEventsLabel      = "events"
+	// a viewer that is not connected by then is dropped
+	webrtcConnectTimeout = 30 * time.Second
+	webrtcGatherTimeout  = 10 * time.Second
+)
+
+var ErrWebrtcClosed = errors.New("session has ended")
+
+// webrtcStream publishes the frames of a session to WebRTC viewers as one
+// VP8 track shared by all of them, the encoder runs while anyone is
+// connected. The events of a frame go out on the "events" data channel
+// the viewer opened right after its picture, so the boxes are drawn in sync
+type webrtcStream struct {
+	session *TrackerSession
+	config  webrtc.Configuration
+	track   *webrtc.TrackLocalStaticSample
+	queue   *frameQueue
+	done    chan struct{}
+
+	lock sync.Mutex
+	// the events channel of every viewer, nil until it is open
+	peers    map[*webrtc.PeerConnection]*webrtc.DataChannel
+	recorder recorder.Recorder
+	// bumped with every encoder, output of an old one is ignored
+	generation int
+	// the frames in the encoder, oldest first
+	pending []webrtcPending
+	closed  bool
+}
+
+// webrtcPending is a frame handed to the encoder, its output is
+// stamped with the capture time and followed by the events
+type webrtcPending struct {
+	at      time.Time
+	message []byte
+}
+
+// webrtcEvents is a message of the events data channel
+type webrtcEvents struct {
+	SessionId   int                  `json:"session_id"`
+	TimestampMs int64                `json:"timestamp_ms"`
+	Events      []archive.TrackEvent `json:"events"`
+}
+
+// newWebrtcStream returns nil when WEBRTC_ENABLED is off
+func newWebrtcStream(session *TrackerSession) *webrtcStream {
+	if !session.env.WEBRTC_ENABLED {
+		return nil
+	}
+	name := fmt.Sprintf("session_%04d", session.sessionId)
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", name)
+	if err != nil {
+		logrus.Errorf("WebRTC view of session %d disabled: %v", session.sessionId, err)
+		return nil
+	}
+	config := webrtc.Configuration{}
+	if len(session.env.WEBRTC_ICE_SERVERS) > 0 {
+		config.ICEServers = []webrtc.ICEServer{{URLs: session.env.WEBRTC_ICE_SERVERS}}
+	}
+	return &webrtcStream{
+		session: session,
+		config:  config,
+		track:   track,
+		queue:   newFrameQueue(webrtcQueueSize, DropOldest),
+		done:    make(chan struct{}),
+		peers:   make(map[*webrtc.PeerConnection]*webrtc.DataChannel),
+	}
+}
+
+func (w *webrtcStream) start() {
+	if w == nil {
+		return
+	}
+	go w.run()
+}
+
+// offer passes the frame on while someone is connected
+func (w *webrtcStream) offer(frame recorder.Frame) {
+	if w == nil || w.count() == 0 {
+		return
+	}
+	w.queue.push(frame)
+}
+
+func (w *webrtcStream) count() int {
+	if w == nil {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.peers)
+}
+
+func (w *webrtcStream) run() {
+	defer close(w.done)
+	for frame := range w.queue.frames {
+		message, err := w.eventsMessage(frame)
+		if err != nil {
+			logrus.Warnf("[%s] Failed to encode WebRTC events: %v", w.session.addr, err)
+			continue
+		}
+		w.lock.Lock()
+		rec := w.recorder
+		if rec != nil {
+			// queued before the frame, the encoder may be quicker than this goroutine
+			w.pending = append(w.pending, webrtcPending{at: frame.Timestamp, message: message})
+		}
+		w.lock.Unlock()
+		if rec == nil {
+			continue
+		}
+		err = rec.WriteFrame(frame)
+		if err == nil {
+			continue
+		}
+		w.lock.Lock()
+		if w.recorder == rec && len(w.pending) > 0 {
+			w.pending = w.pending[:len(w.pending)-1]
+		}
+		w.lock.Unlock()
+		if !errors.Is(err, recorder.ErrNotStarted) && !errors.Is(err, recorder.ErrProcessExited) {
+			logrus.Warnf("[%s] Failed to write WebRTC frame: %v", w.session.addr, err)
+		}
+	}
+}
+
+func (w *webrtcStream) eventsMessage(frame recorder.Frame) ([]byte, error) {
+	message := webrtcEvents{
+		SessionId:   w.session.sessionId,
+		TimestampMs: frame.Timestamp.UnixMilli(),
+		Events:      make([]archive.TrackEvent, 0, len(frame.Events)),
+	}
+	for _, event := range frame.Events {
+		message.Events = append(message.Events, archive.NewTrackEvent(event, frame.Timestamp))
+	}
+	return json.Marshal(message)
+}
+
+// answer connects a viewer, offer is the session description of the
+// browser. Candidates are gathered before answering, no trickle ICE
+func (w *webrtcStream) answer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	pc, err := webrtc.NewPeerConnection(w.config)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.setup(pc, offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		pc.Close()
+		return nil, ErrWebrtcClosed
+	}
+	if w.recorder != nil {
+		select {
+		case <-w.recorder.Done():
+			// died, e.g. ffmpeg is missing, the new viewer tries again
+			go w.recorder.Stop()
+			w.recorder = nil
+		default:
+		}
+	}
+	if w.recorder == nil {
+		if err := w.startEncoder(); err != nil {
+			w.lock.Unlock()
+			pc.Close()
+			return nil, err
+		}
+	}
+	w.peers[pc] = nil
+	viewers := len(w.peers)
+	w.lock.Unlock()
+
+	pc.OnDataChannel(func(events *webrtc.DataChannel) {
+		if events.Label() != webrtcEventsLabel {
+			return
+		}
+		events.OnOpen(func() {
+			w.lock.Lock()
+			defer w.lock.Unlock()
+			if _, ok := w.peers[pc]; ok {
+				w.peers[pc] = events
+			}
+		})
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			w.remove(pc)
+		}
+	})
+	time.AfterFunc(webrtcConnectTimeout, func() {
+		if pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			pc.Close()
+		}
+	})
+	logrus.Printf("[%s] WebRTC viewer of session %d joined, %d watching", w.session.addr, w.session.sessionId, viewers)
+	return pc.LocalDescription(), nil
+}
+
+func (w *webrtcStream) setup(pc *webrtc.PeerConnection, offer webrtc.SessionDescription) error {
+	sender, err := pc.AddTrack(w.track)
+	if err != nil {
+		return err
+	}
+	// RTCP has to be read for the interceptors, e.g. NACKs
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(webrtcGatherTimeout):
+		return fmt.Errorf("no ICE candidates after %v", webrtcGatherTimeout)
+	}
+	return nil
+}
+
+// startEncoder runs under the lock
+func (w *webrtcStream) startEncoder() error {
+	w.generation += 1
+	generation := w.generation
+	rec := recorder.NewVp8Stream(webrtcKeyframeInterval, func(stream io.Reader) {
+		w.publish(stream, generation)
+	})
+	if err := rec.Start(fmt.Sprintf("session_%04d_webrtc", w.session.sessionId)); err != nil {
+		return err
+	}
+	w.recorder = rec
+	w.pending = nil
+	return nil
+}
+
+// publish sends every encoded frame to the track and then its events
+func (w *webrtcStream) publish(stream io.Reader, generation int) {
+	ivf, _, err := ivfreader.NewWith(stream)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			logrus.Warnf("[%s] WebRTC encoder output: %v", w.session.addr, err)
+		}
+		return
+	}
+	var last time.Time
+	for {
+		frame, _, err := ivf.ParseNextFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				logrus.Warnf("[%s] WebRTC encoder output: %v", w.session.addr, err)
+			}
+			return
+		}
+
+		w.lock.Lock()
+		if w.generation != generation {
+			w.lock.Unlock()
+			continue
+		}
+		var pending webrtcPending
+		if len(w.pending) > 0 {
+			pending = w.pending[0]
+			w.pending = w.pending[1:]
+		}
+		channels := make([]*webrtc.DataChannel, 0, len(w.peers))
+		for _, events := range w.peers {
+			if events != nil {
+				channels = append(channels, events)
+			}
+		}
+		w.lock.Unlock()
+
+		// the track clock is moved by the capture time since the frame
+		// before, a sample without data only moves it, so every frame is
+		// stamped with its own time without waiting for the next one
+		if !pending.at.IsZero() {
+			if !last.IsZero() && pending.at.After(last) {
+				w.track.WriteSample(media.Sample{Duration: pending.at.Sub(last)})
+			}
+			last = pending.at
+		}
+		if err := w.track.WriteSample(media.Sample{Data: frame}); err != nil {
+			logrus.Debugf("[%s] WebRTC track: %v", w.session.addr, err)
+		}
+		if pending.message == nil {
+			continue
+		}
+		for _, events := range channels {
+			// a closing channel fails, the viewer is about to leave anyway
+			events.Send(pending.message)
+		}
+	}
+}
+
+// remove forgets a viewer, the encoder stops with the last one
+func (w *webrtcStream) remove(pc *webrtc.PeerConnection) {
+	w.lock.Lock()
+	if _, ok := w.peers[pc]; !ok {
+		w.lock.Unlock()
+		return
+	}
+	delete(w.peers, pc)
+	viewers := len(w.peers)
+	var rec recorder.Recorder
+	if viewers == 0 {
+		rec = w.recorder
+		w.recorder = nil
+		w.pending = nil
+	}
+	w.lock.Unlock()
+
+	pc.Close()
+	logrus.Printf("[%s] WebRTC viewer of session %d left, %d watching", w.session.addr, w.session.sessionId, viewers)
+	if rec != nil {
+		if err := rec.Stop(); err != nil {
+			logrus.Debugf("[%s] WebRTC encoder: %v", w.session.addr, err)
+		}
+	}
+}
+
+// close disconnects the viewers with the session
+func (w *webrtcStream) close() {
+	if w == nil {
+		return
+	}
+	w.queue.close()
+	<-w.done
+	w.lock.Lock()
+	w.closed = true
+	peers := make([]*webrtc.PeerConnection, 0, len(w.peers))
+	for pc := range w.peers {
+		peers = append(peers, pc)
+	}
+	w.lock.Unlock()
+	for _, pc := range peers {
+		w.remove(pc)
+	}
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+	"yolo-detector-service/recorder"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DropOldest = "drop-oldest"
+	DropNewest = "drop-newest"
+
+	defaultFrameQueueSize = 128
+)
+
+// frameQueue hands frames from the stream to the session writer,
+// when the encoder falls behind frames are dropped instead of blocking the stream
+type frameQueue struct {
+	frames  chan recorder.Frame
+	policy  string
+	dropped atomic.Int64
+
+	// frames in and frames out, written or dropped, for wait
+	lock   sync.Mutex
+	moved  *sync.Cond
+	queued int64
+	done   int64
+	closed bool
+}
+
+func newFrameQueue(size int, policy string) *frameQueue {
+	if size <= 0 {
+		size = defaultFrameQueueSize
+	}
+	switch policy {
+	case DropOldest, DropNewest:
+	case "":
+		policy = DropOldest
+	default:
+		logrus.Warnf("Unknown frame queue drop policy %q, using %s", policy, DropOldest)
+		policy = DropOldest
+	}
+	q := &frameQueue{
+		frames: make(chan recorder.Frame, size),
+		policy: policy,
+	}
+	q.moved = sync.NewCond(&q.lock)
+	return q
+}
+
+// push never blocks, it returns false if a frame had to be dropped
+// or the queue is closed
+func (q *frameQueue) push(frame recorder.Frame) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return false
+	}
+	dropped := false
+	for {
+		select {
+		case q.frames <- frame:
+			q.queued += 1
+			return !dropped
+		default:
+		}
+		if q.policy == DropNewest {
+			q.dropped.Add(1)
+			return false
+		}
+		select {
+		case <-q.frames:
+			dropped = true
+			q.dropped.Add(1)
+			q.taken()
+		default:
+			// the writer took one meanwhile
+		}
+	}
+}
+
+// written is called by the writer for every frame it took
+func (q *frameQueue) written() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.taken()
+}
+
+func (q *frameQueue) taken() {
+	q.done += 1
+	q.moved.Broadcast()
+}
+
+// wait returns once the frames queued so far are written or dropped,
+// frames leave in order so the count tells
+func (q *frameQueue) wait() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	until := q.queued
+	for q.done < until {
+		q.moved.Wait()
+	}
+}
+
+// close ends the writer once the queued frames are written,
+// frames pushed afterwards are ignored
+func (q *frameQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	close(q.frames)
+}
+
+// reportDrops warns once per timer tick in which frames were dropped
+func (cc *TrackerSession) reportDrops() {
+	dropped := cc.queue.dropped.Load()
+	if dropped > cc.reportedDrops {
+		logrus.Warnf("[%s] Recorder queue full, %d frames dropped (%s)",
+			cc.addr, dropped-cc.reportedDrops, cc.queue.policy)
+		cc.reportedDrops = dropped
+	}
+}
+
+// runWriter feeds the recorder with the queued frames,
+// the pre-roll goes first when a recording has just started
+func (cc *TrackerSession) runWriter() {
+	defer cc.writing.Done()
+	for frame := range cc.queue.frames {
+		var preRoll []recorder.Frame
+		cc.lock.Lock()
+		// while the tail of a recording is written the buffer
+		// fills up for the next one
+		if cc.state == StateRun && cc.trackerTime.preRoll.len() > 0 {
+			preRoll = cc.trackerTime.preRoll.drain()
+		}
+		cc.lock.Unlock()
+		for _, buffered := range preRoll {
+			cc.writeFrame(buffered)
+		}
+		cc.writeFrame(frame)
+		cc.queue.written()
+	}
+}
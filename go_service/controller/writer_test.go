@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+	"yolo-detector-service/recorder"
+)
+
+// takeAll empties the queue without waiting, as frames written
+func takeAll(q *frameQueue) []recorder.Frame {
+	var frames []recorder.Frame
+	for {
+		select {
+		case frame, ok := <-q.frames:
+			if !ok {
+				return frames
+			}
+			frames = append(frames, frame)
+			q.written()
+		default:
+			return frames
+		}
+	}
+}
+
+func TestFrameQueueDropPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		// pushes 0 to 4 into a queue of 2
+		wantPushed []bool
+		wantKept   []byte
+	}{
+		{
+			policy:     DropOldest,
+			wantPushed: []bool{true, true, false, false, false},
+			wantKept:   []byte{3, 4},
+		},
+		{
+			policy:     DropNewest,
+			wantPushed: []bool{true, true, false, false, false},
+			wantKept:   []byte{0, 1},
+		},
+		{
+			// unknown policies drop the oldest
+			policy:     "drop-none",
+			wantPushed: []bool{true, true, false, false, false},
+			wantKept:   []byte{3, 4},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			q := newFrameQueue(2, test.policy)
+			var pushed []bool
+			for i := range 5 {
+				pushed = append(pushed, q.push(testFrame(byte(i), i*40, 1)))
+			}
+			if !slices.Equal(pushed, test.wantPushed) {
+				t.Fatalf("pushed %v, want %v", pushed, test.wantPushed)
+			}
+			if dropped := q.dropped.Load(); dropped != 3 {
+				t.Fatalf("%d frames counted as dropped, want 3", dropped)
+			}
+			if kept := frameIds(takeAll(q)); !slices.Equal(kept, test.wantKept) {
+				t.Fatalf("kept %v, want %v", kept, test.wantKept)
+			}
+			// the dropped and the written frames are all accounted for
+			if q.queued != q.done {
+				t.Fatalf("%d frames queued, %d out", q.queued, q.done)
+			}
+		})
+	}
+}
+
+func TestFrameQueueWaitForWriter(t *testing.T) {
+	q := newFrameQueue(8, DropOldest)
+	for i := range 5 {
+		q.push(testFrame(byte(i), i*40, 1))
+	}
+	var written atomic.Int64
+	go func() {
+		for range q.frames {
+			// a slow encoder
+			time.Sleep(10 * time.Millisecond)
+			written.Add(1)
+			q.written()
+		}
+	}()
+	q.wait()
+	if n := written.Load(); n != 5 {
+		t.Fatalf("wait returned after %d of 5 frames were written", n)
+	}
+	q.close()
+}
+
+func TestFrameQueueWaitCountsDrops(t *testing.T) {
+	q := newFrameQueue(2, DropOldest)
+	for i := range 4 {
+		q.push(testFrame(byte(i), i*40, 1))
+	}
+	done := make(chan struct{})
+	go func() {
+		q.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("wait returned with two frames still queued")
+	case <-time.After(20 * time.Millisecond):
+	}
+	takeAll(q)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait did not return once the queue was written")
+	}
+}
+
+func TestFrameQueuePushAfterClose(t *testing.T) {
+	q := newFrameQueue(2, DropOldest)
+	q.push(testFrame(0, 0, 1))
+	q.close()
+	if q.push(testFrame(1, 40, 1)) {
+		t.Fatal("frame taken by a closed queue")
+	}
+	q.close()
+	if kept := frameIds(takeAll(q)); !slices.Equal(kept, []byte{0}) {
+		t.Fatalf("closed queue holds %v, want the frame queued before", kept)
+	}
+	q.wait()
+}
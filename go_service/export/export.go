@@ -0,0 +1,307 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/bootstrap"
+	"yolo-detector-service/recorder"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrBadRange     = errors.New("the end of the range must be after its start")
+	ErrRangeTooLong = errors.New("the range is longer than EXPORT_MAX_DURATION")
+	ErrNoRecordings = errors.New("no recordings of the camera in the range")
+	ErrMixedFormats = errors.New("the recordings in the range have different formats, export shorter ranges")
+)
+
+// the sidecar event of timelapse recordings, as in the controller,
+// their frames are retimed and cannot be cut by capture time
+const timelapseEvent = "timelapse"
+
+// errDone stops reading a recording once the range is passed
+var errDone = errors.New("range done")
+
+// Exporter cuts a time range of a camera out of the archived recordings
+// and joins the pieces into one file without re-encoding them
+type Exporter struct {
+	env   *bootstrap.Env
+	key   *archive.Key
+	roots []string
+}
+
+// Source is a recording covering part of the range
+type Source struct {
+	// as stored, encrypted files end with archive.EncryptedExt
+	Path    string
+	Backend string
+	Start   time.Time
+	End     time.Time
+}
+
+// Clip is an exported range in a temporary file, the caller removes it
+type Clip struct {
+	Path    string
+	Name    string
+	Sources []Source
+}
+
+func New(env *bootstrap.Env, key *archive.Key) *Exporter {
+	e := &Exporter{env: env, key: key}
+	for _, dir := range []string{env.ARCHIVE_DIR, env.RECORDINGS_TMP_DIR} {
+		if dir != "" && !slices.Contains(e.roots, filepath.Clean(dir)) {
+			e.roots = append(e.roots, filepath.Clean(dir))
+		}
+	}
+	return e
+}
+
+// Find lists the video recordings of camera overlapping from..to, oldest first
+func (e *Exporter) Find(camera string, from time.Time, to time.Time) ([]Source, error) {
+	var sources []Source
+	for _, root := range e.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			name := strings.TrimSuffix(d.Name(), archive.EncryptedExt)
+			if d.IsDir() || filepath.Ext(name) != ".json" || strings.HasPrefix(name, ".") {
+				return nil
+			}
+			sidecar, err := archive.ReadSidecar(path, e.key)
+			if err != nil {
+				logrus.Warnf("Export skips %s: %v", path, err)
+				return nil
+			}
+			if sidecar.File == "" || sidecar.Camera != camera || sidecar.Event == timelapseEvent {
+				return nil
+			}
+			if sidecar.StartedAt.After(to) || sidecar.EndedAt.Before(from) {
+				return nil
+			}
+			video := filepath.Join(filepath.Dir(path), sidecar.File)
+			switch videoExt(video) {
+			case ".mkv", ".mp4":
+			default:
+				// stills of snapshot mode
+				return nil
+			}
+			if _, err := os.Stat(video); err != nil {
+				return nil
+			}
+			sources = append(sources, Source{
+				Path:    video,
+				Backend: sidecar.Backend,
+				Start:   sidecar.StartedAt,
+				End:     sidecar.EndedAt,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", root, err)
+		}
+	}
+	slices.SortFunc(sources, func(a, b Source) int {
+		return a.Start.Compare(b.Start)
+	})
+	return sources, nil
+}
+
+// Export cuts from..to of camera into one file, Matroska recordings of the
+// mjpeg backend are joined frame by frame, mp4 recordings by ffmpeg stream copy
+func (e *Exporter) Export(camera string, from time.Time, to time.Time) (*Clip, error) {
+	if !to.After(from) {
+		return nil, ErrBadRange
+	}
+	if maxDuration := e.env.EXPORT_MAX_DURATION; maxDuration > 0 && to.Sub(from) > maxDuration {
+		return nil, ErrRangeTooLong
+	}
+	sources, err := e.Find(camera, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, ErrNoRecordings
+	}
+	ext := videoExt(sources[0].Path)
+	for _, source := range sources {
+		if videoExt(source.Path) != ext {
+			return nil, ErrMixedFormats
+		}
+	}
+	out, err := os.CreateTemp(e.env.RECORDINGS_TMP_DIR, ".export-*"+ext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create export file: %w", err)
+	}
+	clip := &Clip{
+		Path:    out.Name(),
+		Name:    clipName(camera, from, to, ext),
+		Sources: sources,
+	}
+	if ext == ".mkv" {
+		err = e.joinMkv(sources, from, to, out)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		out.Close()
+		err = e.joinFfmpeg(sources, from, to, clip.Path)
+	}
+	if err != nil {
+		os.Remove(clip.Path)
+		return nil, err
+	}
+	logrus.Printf("Exported %s of camera %s from %d recordings [%s]", clip.Name, camera, len(sources), clip.Path)
+	return clip, nil
+}
+
+// joinMkv copies the frames in the range as they are, where recordings
+// overlap the frames already written win
+func (e *Exporter) joinMkv(sources []Source, from time.Time, to time.Time, out io.Writer) error {
+	mkv := recorder.NewMkvFile(out)
+	var last time.Time
+	for _, source := range sources {
+		err := e.open(source, func(in io.Reader) error {
+			return recorder.ReadMkv(in, func(frame recorder.Frame) error {
+				if frame.Timestamp.After(to) {
+					return errDone
+				}
+				if frame.Timestamp.Before(from) || !frame.Timestamp.After(last) {
+					return nil
+				}
+				last = frame.Timestamp
+				return mkv.WriteFrame(frame)
+			})
+		})
+		if err != nil && !errors.Is(err, errDone) {
+			return fmt.Errorf("failed to read %s: %w", source.Path, err)
+		}
+	}
+	if mkv.Frames() == 0 {
+		return ErrNoRecordings
+	}
+	return mkv.Close()
+}
+
+// joinFfmpeg hands the pieces to the concat demuxer of ffmpeg, the cuts
+// land on the nearest keyframes as nothing is re-encoded
+func (e *Exporter) joinFfmpeg(sources []Source, from time.Time, to time.Time, output string) error {
+	dir, err := os.MkdirTemp(e.env.RECORDINGS_TMP_DIR, ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	var list strings.Builder
+	var last time.Time
+	for i, source := range sources {
+		if !source.End.After(last) {
+			// covered by the recordings before
+			continue
+		}
+		path := source.Path
+		if archive.IsEncrypted(path) {
+			if e.key == nil {
+				return fmt.Errorf("%s is encrypted and no key is configured", path)
+			}
+			path = filepath.Join(dir, fmt.Sprintf("%03d%s", i, videoExt(path)))
+			if err := archive.DecryptFile(source.Path, path, e.key); err != nil {
+				return fmt.Errorf("failed to decrypt %s: %w", source.Path, err)
+			}
+		}
+		start := from
+		if last.After(start) {
+			start = last
+		}
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(path, "'", `'\''`))
+		if inpoint := start.Sub(source.Start); inpoint > 0 {
+			fmt.Fprintf(&list, "inpoint %.3f\n", inpoint.Seconds())
+		}
+		if to.Before(source.End) {
+			fmt.Fprintf(&list, "outpoint %.3f\n", to.Sub(source.Start).Seconds())
+		}
+		last = source.End
+	}
+	listPath := filepath.Join(dir, "concat.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0600); err != nil {
+		return err
+	}
+	cmd := exec.Command("ffmpeg",
+		"-hide_banner", "-loglevel", "error",
+		"-f", "concat", "-safe", "0", "-i", listPath,
+		"-c", "copy", "-movflags", "+faststart",
+		"-y", output,
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (e *Exporter) open(source Source, fn func(in io.Reader) error) error {
+	file, err := os.Open(source.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if !archive.IsEncrypted(source.Path) {
+		return fn(file)
+	}
+	if e.key == nil {
+		return fmt.Errorf("recording is encrypted and no key is configured")
+	}
+	plain, err := archive.NewDecryptReader(file, e.key)
+	if err != nil {
+		return err
+	}
+	return fn(plain)
+}
+
+func videoExt(path string) string {
+	return filepath.Ext(strings.TrimSuffix(path, archive.EncryptedExt))
+}
+
+func clipName(camera string, from time.Time, to time.Time, ext string) string {
+	entry := archive.Entry{Camera: camera, Start: from}
+	return entry.Expand("{camera}_{start}") + "-" + to.Local().Format("20060102T150405") + ext
+}
+
+var timeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// ParseTime reads RFC 3339 or local date and time, a bare 15:04[:05] is today
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			year, month, day := now.Local().Date()
+			return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), 0, time.Local), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time, e.g. 2026-03-01T14:02:00 or 14:02", value)
+}
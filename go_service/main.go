@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+	"yolo-detector-service/archive"
 	"yolo-detector-service/bootstrap"
 	"yolo-detector-service/controller"
+	"yolo-detector-service/retention"
 
 	pb "yolo-detector-service/grpc/generated"
 
@@ -16,7 +21,13 @@ import (
 	"google.golang.org/grpc"
 )
 
+// how long open requests and streams may take once a signal arrived
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
 	if len(os.Args) != 2 {
 		logrus.Fatal("Failed, config path as argument is required")
 	}
@@ -27,17 +38,36 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	var key *archive.Key
+	if env.ENCRYPTION_KEY_FILE != "" {
+		var err error
+		key, err = archive.LoadKey(env.ENCRYPTION_KEY_FILE)
+		if err != nil {
+			logrus.Fatalf("Failed to load encryption key: %v", err)
+		}
+		logrus.Info("Recordings are encrypted at rest")
+	}
+
+	manifest := archive.NewManifest(env)
+	markers := archive.NewMarkerIndex(env)
+
 	// ---- gRPC ----
 	trackerListen, err := net.Listen("tcp", env.EVENT_SERVER_IP+":"+env.EVENT_SERVER_PORT)
 	if err != nil {
 		logrus.Fatalf("Failed to listen: %v", err)
 	}
-	grpcServer := grpc.NewServer()
+	// Stop waits for the sessions to finalize their recordings
+	grpcServer := grpc.NewServer(grpc.WaitForHandlers(true))
 
 	tracker := &controller.TrackerServer{
 		UnimplementedTrackerServiceServer: pb.UnimplementedTrackerServiceServer{},
 		Env:                               env,
 		Trackers:                          make(map[string]*controller.TrackerSession),
+		PreRollBudget:                     controller.NewByteBudget(env.PRE_ROLL_GLOBAL_MAX_BYTES),
+		DiskGuard:                         controller.NewDiskGuard(env),
+		Key:                               key,
+		Manifest:                          manifest,
+		Markers:                           markers,
 	}
 	pb.RegisterTrackerServiceServer(grpcServer, tracker)
 
@@ -49,20 +79,66 @@ func main() {
 		}
 	}()
 
+	go retention.New(env, key, manifest, markers).Run(ctx)
+
 	// ---- REST ----
 	router := gin.New()
 	router.Use(gin.Recovery())
 
 	router.POST("/v1/test", tracker.TestMethod)
+	router.GET("/v1/status", tracker.Status)
+	// watched from pages of CORS_ALLOWED_ORIGINS
+	viewing := router.Group("/v1/sessions/:id", controller.AllowBrowsers(env))
+	viewing.GET("/live/:file", tracker.Live)
+	viewing.GET("/mjpeg", tracker.Mjpeg)
+	viewing.GET("/snapshot.jpg", tracker.Snapshot)
+	viewing.GET("/snapshot.json", tracker.SnapshotEvents)
 
-	logrus.Printf("REST Server listening on %s", env.REST_PORT)
+	recordings := &controller.RecordingsController{Env: env, Key: key, Manifest: manifest}
+	router.GET("/v1/recordings/*path", recordings.Download)
+	router.GET("/v1/verify", recordings.Verify)
+	router.GET("/v1/export", recordings.Export)
 
-	err = router.Run(env.REST_IP + ":" + env.REST_PORT)
-	if err != nil {
-		logrus.Fatalf("Failed to serve: %v", err)
+	servers := []*http.Server{{Addr: env.REST_IP + ":" + env.REST_PORT, Handler: router}}
+
+	// ---- WebRTC signaling ----
+	if env.WEBRTC_ENABLED {
+		signaling := gin.New()
+		signaling.Use(gin.Recovery(), controller.AllowBrowsers(env))
+		signaling.POST("/v1/sessions/:id/webrtc", tracker.Webrtc)
+		signaling.OPTIONS("/v1/sessions/:id/webrtc")
+		servers = append(servers, &http.Server{Addr: env.WEBRTC_IP + ":" + env.WEBRTC_PORT, Handler: signaling})
+	}
+
+	for _, server := range servers {
+		go func() {
+			logrus.Printf("HTTP Server listening on %s", server.Addr)
+			err := server.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Fatalf("Failed to serve: %v", err)
+			}
+		}()
 	}
 
 	<-ctx.Done()
 	logrus.Info("Shutting down...")
-	grpcServer.GracefulStop()
+	shutdown, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdown); err != nil {
+			logrus.Warnf("HTTP Server %s: %v", server.Addr, err)
+		}
+	}
+	// the detectors stream until they are cut off, sessions finalize their recordings
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-shutdown.Done():
+		grpcServer.Stop()
+		<-stopped
+	}
 }
@@ -0,0 +1,166 @@
+package overlay
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"strconv"
+	"strings"
+	"yolo-detector-service/bootstrap"
+	pb "yolo-detector-service/grpc/generated"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	lineWidth      = 2
+	labelPadding   = 2
+	defaultQuality = 85
+)
+
+// classes without a configured colour get one of these, picked by name
+var palette = []color.RGBA{
+	{230, 25, 75, 255},
+	{60, 180, 75, 255},
+	{255, 225, 25, 255},
+	{0, 130, 200, 255},
+	{245, 130, 48, 255},
+	{145, 30, 180, 255},
+	{70, 240, 240, 255},
+	{240, 50, 230, 255},
+}
+
+// Renderer draws detection boxes with class, confidence and tracker id into JPEG frames
+type Renderer struct {
+	colors  map[string]color.RGBA
+	quality int
+	face    font.Face
+}
+
+// New returns the renderer configured with OVERLAY_COLORS and OVERLAY_JPEG_QUALITY
+func New(env *bootstrap.Env) *Renderer {
+	r := &Renderer{
+		colors:  make(map[string]color.RGBA),
+		quality: env.OVERLAY_JPEG_QUALITY,
+		face:    basicfont.Face7x13,
+	}
+	if r.quality <= 0 || r.quality > 100 {
+		r.quality = defaultQuality
+	}
+	for _, item := range env.OVERLAY_COLORS {
+		name, value, ok := strings.Cut(item, ":")
+		if !ok {
+			logrus.Warnf("Overlay colour %q is not class:rrggbb", item)
+			continue
+		}
+		c, err := parseHexColor(value)
+		if err != nil {
+			logrus.Warnf("Overlay colour of %s: %v", name, err)
+			continue
+		}
+		r.colors[strings.TrimSpace(name)] = c
+	}
+	return r
+}
+
+// Draw decodes frame, draws the events on it and encodes it again
+func (r *Renderer) Draw(frame []byte, events []*pb.TrackEvent) ([]byte, error) {
+	if len(events) == 0 {
+		return frame, nil
+	}
+	src, err := jpeg.Decode(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode frame: %w", err)
+	}
+	img := image.NewRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+	for _, event := range events {
+		r.drawEvent(img, event)
+	}
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: r.quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode frame: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+func (r *Renderer) drawEvent(img *image.RGBA, event *pb.TrackEvent) {
+	box := event.GetBox()
+	rect := image.Rect(
+		int(box.GetX()), int(box.GetY()),
+		int(box.GetX()+box.GetWidth()), int(box.GetY()+box.GetHeight()),
+	).Intersect(img.Bounds())
+	if rect.Empty() {
+		return
+	}
+	c := r.color(event.GetClassName())
+	fill := image.NewUniform(c)
+	for i := 0; i < lineWidth; i++ {
+		inner := rect.Inset(i)
+		draw.Draw(img, image.Rect(inner.Min.X, inner.Min.Y, inner.Max.X, inner.Min.Y+1), fill, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(inner.Min.X, inner.Max.Y-1, inner.Max.X, inner.Max.Y), fill, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(inner.Min.X, inner.Min.Y, inner.Min.X+1, inner.Max.Y), fill, image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(inner.Max.X-1, inner.Min.Y, inner.Max.X, inner.Max.Y), fill, image.Point{}, draw.Src)
+	}
+
+	label := Label(event)
+	metrics := r.face.Metrics()
+	height := (metrics.Ascent + metrics.Descent).Ceil() + 2*labelPadding
+	width := font.MeasureString(r.face, label).Ceil() + 2*labelPadding
+	// above the box, inside it when there is no room
+	top := rect.Min.Y - height
+	if top < img.Bounds().Min.Y {
+		top = rect.Min.Y
+	}
+	background := image.Rect(rect.Min.X, top, rect.Min.X+width, top+height).Intersect(img.Bounds())
+	draw.Draw(img, background, fill, image.Point{}, draw.Src)
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(textColor(c)),
+		Face: r.face,
+		Dot:  fixed.P(rect.Min.X+labelPadding, top+labelPadding+metrics.Ascent.Ceil()),
+	}
+	drawer.DrawString(label)
+}
+
+func (r *Renderer) color(className string) color.RGBA {
+	if c, ok := r.colors[className]; ok {
+		return c
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(className))
+	return palette[hash.Sum32()%uint32(len(palette))]
+}
+
+// Label is the text shown next to a detection, e.g. "person #3 0.87"
+func Label(event *pb.TrackEvent) string {
+	return fmt.Sprintf("%s #%d %.2f", event.GetClassName(), event.GetTrackerId(), event.GetConfidence())
+}
+
+// textColor picks black or white, whichever reads better on c
+func textColor(c color.RGBA) color.Color {
+	luma := 299*int(c.R) + 587*int(c.G) + 114*int(c.B)
+	if luma > 128*1000 {
+		return color.Black
+	}
+	return color.White
+}
+
+func parseHexColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(value) != 6 {
+		return color.RGBA{}, fmt.Errorf("%q is not rrggbb", value)
+	}
+	rgb, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("%q is not rrggbb", value)
+	}
+	return color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 255}, nil
+}
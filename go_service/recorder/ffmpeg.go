@@ -0,0 +1,25 @@
+package recorder
+
+// NewFfmpeg encodes frames to h264 mp4 with ffmpeg
+func NewFfmpeg() Recorder {
+	return &processRecorder{
+		backend:   BackendFfmpeg,
+		extension: ".mp4",
+		binary:    "ffmpeg",
+		args:      ffmpegArgs,
+	}
+}
+
+func ffmpegArgs(path string) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "warning",
+		"-f", "matroska", "-i", "pipe:0",
+		// keep the capture timestamps, no frames are duplicated or dropped
+		"-fps_mode", "passthrough",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		// fragmented mp4 stays playable if the process is killed
+		"-movflags", "+frag_keyframe+empty_moov",
+		"-y", path,
+	}
+}
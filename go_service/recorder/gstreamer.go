@@ -0,0 +1,28 @@
+package recorder
+
+// NewGStreamer encodes frames to h264 mp4 with gst-launch-1.0
+func NewGStreamer() Recorder {
+	return &processRecorder{
+		backend:   BackendGStreamer,
+		extension: ".mp4",
+		binary:    "gst-launch-1.0",
+		args:      gstreamerArgs,
+	}
+}
+
+// the frames come in a Matroska stream, matroskademux hands the capture
+// timestamps to the encoder so the file plays at real speed for any fps
+func gstreamerArgs(path string) []string {
+	return []string{
+		"-e",
+		"fdsrc",
+		"!", "matroskademux",
+		"!", "jpegdec",
+		"!", "videoconvert",
+		"!", "x264enc", "tune=zerolatency", "speed-preset=ultrafast",
+		"!", "h264parse",
+		"!", "mp4mux", "fragment-duration=2000",
+		"!", "filesink",
+		"location=" + path, "sync=false",
+	}
+}
@@ -0,0 +1,41 @@
+package recorder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// NewHls encodes frames to a rolling HLS playlist with ffmpeg, the playlist
+// keeps size segments of segmentTime each and older segments are deleted
+func NewHls(segmentTime time.Duration, size int) Recorder {
+	return &processRecorder{
+		backend:   BackendHls,
+		extension: ".m3u8",
+		binary:    "ffmpeg",
+		args: func(path string) []string {
+			return hlsArgs(path, segmentTime, size)
+		},
+		live: true,
+	}
+}
+
+func hlsArgs(path string, segmentTime time.Duration, size int) []string {
+	seconds := strconv.FormatFloat(segmentTime.Seconds(), 'f', -1, 64)
+	return []string{
+		"-hide_banner", "-loglevel", "warning",
+		"-f", "matroska", "-i", "pipe:0",
+		"-fps_mode", "passthrough",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-pix_fmt", "yuv420p",
+		// a keyframe opens every segment, players can join at any of them
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%s)", seconds),
+		"-f", "hls",
+		"-hls_time", seconds,
+		"-hls_list_size", strconv.Itoa(size),
+		"-hls_flags", "delete_segments+independent_segments",
+		"-hls_segment_filename", filepath.Join(filepath.Dir(path), "segment_%05d.ts"),
+		"-y", path,
+	}
+}
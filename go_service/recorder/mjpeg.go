@@ -0,0 +1,115 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MjpegRecorder stores the incoming JPEGs as they are in a Matroska file,
+// nothing is decoded or encoded and no external binary is needed
+type MjpegRecorder struct {
+	file   *os.File
+	writer *mkvWriter
+	done   chan struct{}
+	info   Info
+	lock   sync.Mutex
+}
+
+func NewMjpeg() Recorder {
+	return &MjpegRecorder{}
+}
+
+func (r *MjpegRecorder) Start(basePath string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file != nil {
+		return fmt.Errorf("%s recorder is already started", BackendMjpeg)
+	}
+	path := basePath + ".mkv"
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create recording: %w", err)
+	}
+	r.file = file
+	r.writer = nil
+	r.done = make(chan struct{})
+	r.info = Info{
+		Backend:   BackendMjpeg,
+		Path:      path,
+		StartedAt: time.Now(),
+	}
+	logrus.Printf("%s recording started [%s]", BackendMjpeg, path)
+	return nil
+}
+
+func (r *MjpegRecorder) WriteFrame(frame Frame) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return ErrNotStarted
+	}
+	if r.writer == nil {
+		writer, err := newMkvWriterForFrame(r.file, frame.Data)
+		if err != nil {
+			return err
+		}
+		r.writer = writer
+	}
+	before := r.writer.written
+	err := r.writer.WriteFrame(frame.Data, frame.Timestamp)
+	r.info.Bytes += r.writer.written - before
+	if err != nil {
+		// the file is unusable from here, end the recording as truncated
+		r.info.Truncated = true
+		r.finish()
+		return fmt.Errorf("failed to write frame to %s: %w", r.info.Path, err)
+	}
+	r.info.addFrame(frame)
+	return nil
+}
+
+func (r *MjpegRecorder) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.finish()
+	if err != nil {
+		return fmt.Errorf("failed to finish %s: %w", r.info.Path, err)
+	}
+	logrus.Printf("%s recording finished [%s]", BackendMjpeg, r.info.Path)
+	return nil
+}
+
+func (r *MjpegRecorder) finish() error {
+	var err error
+	if r.writer != nil {
+		err = r.writer.Close()
+		r.info.Bytes = r.writer.written
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	r.writer = nil
+	r.info.StoppedAt = time.Now()
+	close(r.done)
+	return err
+}
+
+func (r *MjpegRecorder) Done() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.done
+}
+
+func (r *MjpegRecorder) Info() Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.info
+}
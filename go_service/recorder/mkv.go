@@ -0,0 +1,381 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"math"
+	"time"
+)
+
+// Matroska element ids, see https://www.matroska.org/technical/elements.html
+const (
+	mkvEBML               = 0x1A45DFA3
+	mkvEBMLVersion        = 0x4286
+	mkvEBMLReadVersion    = 0x42F7
+	mkvEBMLMaxIDLength    = 0x42F2
+	mkvEBMLMaxSizeLength  = 0x42F3
+	mkvDocType            = 0x4282
+	mkvDocTypeVersion     = 0x4287
+	mkvDocTypeReadVersion = 0x4285
+	mkvSegment            = 0x18538067
+	mkvSeekHead           = 0x114D9B74
+	mkvSeek               = 0x4DBB
+	mkvSeekID             = 0x53AB
+	mkvSeekPosition       = 0x53AC
+	mkvVoid               = 0xEC
+	mkvInfo               = 0x1549A966
+	mkvTimecodeScale      = 0x2AD7B1
+	mkvMuxingApp          = 0x4D80
+	mkvWritingApp         = 0x5741
+	mkvDuration           = 0x4489
+	mkvDateUTC            = 0x4461
+	mkvTracks             = 0x1654AE6B
+	mkvTrackEntry         = 0xAE
+	mkvTrackNumber        = 0xD7
+	mkvTrackUID           = 0x73C5
+	mkvTrackType          = 0x83
+	mkvFlagLacing         = 0x9C
+	mkvCodecID            = 0x86
+	mkvVideo              = 0xE0
+	mkvPixelWidth         = 0xB0
+	mkvPixelHeight        = 0xBA
+	mkvCluster            = 0x1F43B675
+	mkvTimecode           = 0xE7
+	mkvSimpleBlock        = 0xA3
+	mkvCues               = 0x1C53BB6B
+	mkvCuePoint           = 0xBB
+	mkvCueTime            = 0xB3
+	mkvCueTrackPositions  = 0xB7
+	mkvCueTrack           = 0xF7
+	mkvCueClusterPosition = 0xF1
+)
+
+const (
+	mkvAppName = "yolo-detector-service"
+	// size of the placeholder rewritten with the seek head on close
+	mkvSeekHeadReserve = 64
+	// keeps relative block timecodes, int16 milliseconds, far from overflow
+	mkvClusterDuration = time.Second
+	mkvUnknownSize     = 0x01FFFFFFFFFFFFFF
+)
+
+var mkvEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mkvWriter muxes JPEG frames into a Matroska V_MJPEG track
+// with millisecond timestamps taken from the frames.
+// When the output is seekable the segment size, duration,
+// cues and seek head are patched in on Close.
+// Streaming writes every frame at once in a cluster of its own, for
+// encoders serving live viewers, and keeps no cues as nobody seeks
+type mkvWriter struct {
+	out           io.Writer
+	streaming     bool
+	width         int
+	height        int
+	written       int64
+	segmentData   int64 // offset of the first byte inside Segment
+	seekHeadPos   int64
+	durationPos   int64
+	first         time.Time
+	last          time.Duration
+	lastDelta     time.Duration
+	frames        int
+	cluster       bytes.Buffer
+	clusterTime   time.Duration
+	clusterFrames int
+	cues          []mkvCue
+	headerWritten bool
+}
+
+type mkvCue struct {
+	time     time.Duration
+	position int64
+}
+
+func newMkvWriter(out io.Writer, width int, height int) *mkvWriter {
+	return &mkvWriter{
+		out:    out,
+		width:  width,
+		height: height,
+	}
+}
+
+// newMkvWriterForFrame sizes the video track from the header of the first JPEG
+func newMkvWriterForFrame(out io.Writer, frame []byte) (*mkvWriter, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jpeg header: %w", err)
+	}
+	return newMkvWriter(out, config.Width, config.Height), nil
+}
+
+func (w *mkvWriter) writeHeader(start time.Time) error {
+	var header bytes.Buffer
+	header.Write(mkvElement(mkvEBML, concat(
+		mkvUint(mkvEBMLVersion, 1),
+		mkvUint(mkvEBMLReadVersion, 1),
+		mkvUint(mkvEBMLMaxIDLength, 4),
+		mkvUint(mkvEBMLMaxSizeLength, 8),
+		mkvString(mkvDocType, "matroska"),
+		mkvUint(mkvDocTypeVersion, 4),
+		mkvUint(mkvDocTypeReadVersion, 2),
+	)))
+	header.Write(mkvID(mkvSegment))
+	header.Write(mkvSize8(mkvUnknownSize))
+	w.segmentData = int64(header.Len())
+
+	w.seekHeadPos = int64(header.Len())
+	header.Write(mkvVoidElement(mkvSeekHeadReserve))
+
+	info := concat(
+		mkvUint(mkvTimecodeScale, uint64(time.Millisecond)),
+		mkvString(mkvMuxingApp, mkvAppName),
+		mkvString(mkvWritingApp, mkvAppName),
+		mkvInt(mkvDateUTC, start.Sub(mkvEpoch).Nanoseconds()),
+	)
+	infoHead := concat(mkvID(mkvInfo), mkvSize(uint64(len(info)+11)))
+	w.durationPos = int64(header.Len()+len(infoHead)+len(info)) + 3
+	header.Write(infoHead)
+	header.Write(info)
+	header.Write(mkvFloat(mkvDuration, 0))
+
+	header.Write(mkvElement(mkvTracks, mkvElement(mkvTrackEntry, concat(
+		mkvUint(mkvTrackNumber, 1),
+		mkvUint(mkvTrackUID, 1),
+		mkvUint(mkvTrackType, 1),
+		mkvUint(mkvFlagLacing, 0),
+		mkvString(mkvCodecID, "V_MJPEG"),
+		mkvElement(mkvVideo, concat(
+			mkvUint(mkvPixelWidth, uint64(w.width)),
+			mkvUint(mkvPixelHeight, uint64(w.height)),
+		)),
+	))))
+	w.headerWritten = true
+	return w.write(header.Bytes())
+}
+
+// WriteFrame appends one JPEG, timestamps going backwards are clamped
+// to the previous frame so the track stays monotonic
+func (w *mkvWriter) WriteFrame(data []byte, timestamp time.Time) error {
+	if !w.headerWritten {
+		w.first = timestamp
+		if err := w.writeHeader(timestamp); err != nil {
+			return err
+		}
+	}
+	pts := timestamp.Sub(w.first).Truncate(time.Millisecond)
+	if pts < w.last {
+		pts = w.last
+	}
+	if w.frames > 0 {
+		w.lastDelta = pts - w.last
+	}
+	if w.clusterFrames > 0 && pts-w.clusterTime >= mkvClusterDuration {
+		if err := w.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if w.clusterFrames == 0 {
+		w.clusterTime = pts
+	}
+	relative := (pts - w.clusterTime).Milliseconds()
+	block := make([]byte, 4, 4+len(data))
+	block[0] = 0x81 // track number 1 as vint
+	binary.BigEndian.PutUint16(block[1:3], uint16(int16(relative)))
+	block[3] = 0x80 // keyframe, every JPEG is
+	block = append(block, data...)
+	w.cluster.Write(mkvElement(mkvSimpleBlock, block))
+	w.clusterFrames += 1
+	w.frames += 1
+	w.last = pts
+	if w.streaming {
+		return w.flushCluster()
+	}
+	return nil
+}
+
+func (w *mkvWriter) flushCluster() error {
+	if w.clusterFrames == 0 {
+		return nil
+	}
+	if !w.streaming {
+		w.cues = append(w.cues, mkvCue{
+			time:     w.clusterTime,
+			position: w.written - w.segmentData,
+		})
+	}
+	body := concat(mkvUint(mkvTimecode, uint64(w.clusterTime.Milliseconds())), w.cluster.Bytes())
+	w.cluster.Reset()
+	w.clusterFrames = 0
+	return w.write(mkvElement(mkvCluster, body))
+}
+
+// Duration is the length of the track written so far
+func (w *mkvWriter) Duration() time.Duration {
+	if w.frames == 0 {
+		return 0
+	}
+	return w.last + w.lastDelta
+}
+
+func (w *mkvWriter) Close() error {
+	if !w.headerWritten {
+		return nil
+	}
+	if err := w.flushCluster(); err != nil {
+		return err
+	}
+	cuesPos := w.written - w.segmentData
+	var cues bytes.Buffer
+	for _, cue := range w.cues {
+		cues.Write(mkvElement(mkvCuePoint, concat(
+			mkvUint(mkvCueTime, uint64(cue.time.Milliseconds())),
+			mkvElement(mkvCueTrackPositions, concat(
+				mkvUint(mkvCueTrack, 1),
+				mkvUint(mkvCueClusterPosition, uint64(cue.position)),
+			)),
+		)))
+	}
+	if err := w.write(mkvElement(mkvCues, cues.Bytes())); err != nil {
+		return err
+	}
+
+	seeker, ok := w.out.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+	if _, err := seeker.Seek(0, io.SeekCurrent); err != nil {
+		// e.g. the stdin pipe of an encoder, an *os.File that cannot seek
+		return nil
+	}
+	end := w.written
+	patches := []struct {
+		offset int64
+		data   []byte
+	}{
+		{w.segmentData - 8, mkvSize8(uint64(end - w.segmentData))},
+		{w.durationPos, float64Bytes(float64(w.Duration().Milliseconds()))},
+		{w.seekHeadPos, mkvSeekHeadElement(mkvCues, cuesPos)},
+	}
+	for _, patch := range patches {
+		if _, err := seeker.Seek(patch.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := seeker.Write(patch.data); err != nil {
+			return err
+		}
+	}
+	_, err := seeker.Seek(end, io.SeekStart)
+	return err
+}
+
+func (w *mkvWriter) write(data []byte) error {
+	n, err := w.out.Write(data)
+	w.written += int64(n)
+	return err
+}
+
+func mkvSeekHeadElement(id uint32, position int64) []byte {
+	seekHead := mkvElement(mkvSeekHead, mkvElement(mkvSeek, concat(
+		mkvElement(mkvSeekID, mkvID(id)),
+		mkvUint(mkvSeekPosition, uint64(position)),
+	)))
+	return append(seekHead, mkvVoidElement(mkvSeekHeadReserve-len(seekHead))...)
+}
+
+// mkvVoidElement is a Void of exactly total bytes including its header
+func mkvVoidElement(total int) []byte {
+	out := []byte{mkvVoid}
+	out = append(out, mkvSize8(uint64(total-9))...)
+	return append(out, make([]byte, total-9)...)
+}
+
+func mkvElement(id uint32, body []byte) []byte {
+	return concat(mkvID(id), mkvSize(uint64(len(body))), body)
+}
+
+func mkvUint(id uint32, value uint64) []byte {
+	n := 1
+	for n < 8 && value>>(8*n) != 0 {
+		n++
+	}
+	body := make([]byte, n)
+	for i := 0; i < n; i++ {
+		body[n-1-i] = byte(value >> (8 * i))
+	}
+	return mkvElement(id, body)
+}
+
+func mkvInt(id uint32, value int64) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, uint64(value))
+	return mkvElement(id, body)
+}
+
+func mkvFloat(id uint32, value float64) []byte {
+	return mkvElement(id, float64Bytes(value))
+}
+
+func mkvString(id uint32, value string) []byte {
+	return mkvElement(id, []byte(value))
+}
+
+func float64Bytes(value float64) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, math.Float64bits(value))
+	return body
+}
+
+// mkvID writes an element id, ids already carry their length marker
+func mkvID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// mkvSize writes the shortest vint able to hold size
+func mkvSize(size uint64) []byte {
+	for n := 1; n <= 8; n++ {
+		// all ones is reserved for the unknown size
+		if size < (1<<(7*n))-1 {
+			out := make([]byte, n)
+			for i := 0; i < n; i++ {
+				out[n-1-i] = byte(size >> (8 * i))
+			}
+			out[0] |= 1 << (8 - n)
+			return out
+		}
+	}
+	panic(errors.New("ebml size overflow"))
+}
+
+// mkvSize8 writes size as an 8 byte vint so it can be patched in place
+func mkvSize8(size uint64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, size&mkvUnknownSize)
+	out[0] |= 0x01
+	return out
+}
+
+func concat(parts ...[]byte) []byte {
+	size := 0
+	for _, part := range parts {
+		size += len(part)
+	}
+	out := make([]byte, 0, size)
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
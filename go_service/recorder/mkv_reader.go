@@ -0,0 +1,180 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// ErrNotMkv is returned for files the mjpeg backend did not write
+var ErrNotMkv = errors.New("not a Matroska recording of this service")
+
+// ReadMkv calls fn with every frame of a recording of the mjpeg backend,
+// timestamps are capture times again. A recording cut short by a crash
+// ends at its last complete frame, an error from fn stops the reading
+func ReadMkv(in io.Reader, fn func(frame Frame) error) error {
+	r := bufio.NewReaderSize(in, 64<<10)
+	var start time.Time
+	var clusterTime time.Duration
+	for {
+		id, size, err := readMkvHeader(r)
+		if err != nil {
+			return truncated(err)
+		}
+		switch id {
+		case mkvSegment, mkvInfo, mkvCluster:
+			// the children follow, they are read in turn
+			continue
+		case mkvEBML, mkvDateUTC, mkvTimecode, mkvSimpleBlock:
+		default:
+			if size == mkvUnknownSize {
+				return fmt.Errorf("%w: element %x of unknown size", ErrNotMkv, id)
+			}
+			if _, err := r.Discard(int(size)); err != nil {
+				return truncated(err)
+			}
+			continue
+		}
+		if size > 64<<20 {
+			return fmt.Errorf("%w: element %x of %d bytes", ErrNotMkv, id, size)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return truncated(err)
+		}
+		switch id {
+		case mkvEBML:
+			if !bytes.Contains(body, mkvString(mkvDocType, "matroska")) {
+				return ErrNotMkv
+			}
+		case mkvDateUTC:
+			if len(body) != 8 {
+				return fmt.Errorf("%w: bad date", ErrNotMkv)
+			}
+			start = mkvEpoch.Add(time.Duration(int64(binary.BigEndian.Uint64(body))))
+		case mkvTimecode:
+			clusterTime = time.Duration(readMkvUint(body)) * time.Millisecond
+		case mkvSimpleBlock:
+			if start.IsZero() {
+				return fmt.Errorf("%w: no start date", ErrNotMkv)
+			}
+			// track number 1 as a one byte vint, int16 timecode, flags
+			if len(body) < 4 || body[0] != 0x81 {
+				continue
+			}
+			relative := time.Duration(int16(binary.BigEndian.Uint16(body[1:3]))) * time.Millisecond
+			frame := Frame{
+				Data:      body[4:],
+				Timestamp: start.Add(clusterTime + relative),
+			}
+			if err := fn(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readMkvHeader reads an element id with its marker and the size without it
+func readMkvHeader(r *bufio.Reader) (uint32, uint64, error) {
+	id, _, err := readMkvVint(r, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, length, err := readMkvVint(r, false)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	if size == (1<<(7*length))-1 {
+		size = mkvUnknownSize
+	}
+	return uint32(id), size, nil
+}
+
+func readMkvVint(r *bufio.Reader, marker bool) (uint64, int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := bits.LeadingZeros8(first) + 1
+	if length > 8 {
+		return 0, 0, fmt.Errorf("%w: bad vint", ErrNotMkv)
+	}
+	value := uint64(first)
+	if !marker {
+		value &= 1<<(8-length) - 1
+	}
+	for i := 1; i < length; i++ {
+		b, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		value = value<<8 | uint64(b)
+	}
+	return value, length, nil
+}
+
+// truncated ends the reading without an error when the file just ends,
+// other errors, e.g. of a decrypting reader, are passed on
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+func readMkvUint(body []byte) uint64 {
+	var value uint64
+	for _, b := range body {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// MkvFile muxes frames into a Matroska file like the mjpeg backend,
+// for writing recordings made of other recordings, e.g. exported clips
+type MkvFile struct {
+	out    io.Writer
+	writer *mkvWriter
+}
+
+// NewMkvFile writes to out, seekable outputs get a duration and cues
+func NewMkvFile(out io.Writer) *MkvFile {
+	return &MkvFile{out: out}
+}
+
+func (m *MkvFile) WriteFrame(frame Frame) error {
+	if m.writer == nil {
+		writer, err := newMkvWriterForFrame(m.out, frame.Data)
+		if err != nil {
+			return err
+		}
+		m.writer = writer
+	}
+	return m.writer.WriteFrame(frame.Data, frame.Timestamp)
+}
+
+// Frames is how many frames were written
+func (m *MkvFile) Frames() int {
+	if m.writer == nil {
+		return 0
+	}
+	return m.writer.frames
+}
+
+func (m *MkvFile) Close() error {
+	if m.writer == nil {
+		return nil
+	}
+	return m.writer.Close()
+}
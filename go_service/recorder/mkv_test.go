@@ -0,0 +1,219 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testFrames are n frames about 40ms apart starting at an odd nanosecond,
+// long enough to span several clusters
+func testFrames(n int) []Frame {
+	start := time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	frames := make([]Frame, n)
+	for i := range frames {
+		frames[i] = Frame{
+			Data:      bytes.Repeat([]byte{0xFF, 0xD8, byte(i)}, i+1),
+			Timestamp: start.Add(time.Duration(i*40+i%3) * time.Millisecond),
+		}
+	}
+	return frames
+}
+
+func writeMkv(t *testing.T, w *mkvWriter, frames []Frame) {
+	t.Helper()
+	for _, frame := range frames {
+		if err := w.WriteFrame(frame.Data, frame.Timestamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFrames(t *testing.T, data []byte) []Frame {
+	t.Helper()
+	var frames []Frame
+	err := ReadMkv(bytes.NewReader(data), func(frame Frame) error {
+		frames = append(frames, Frame{Data: bytes.Clone(frame.Data), Timestamp: frame.Timestamp})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func compareFrames(t *testing.T, got []Frame, want []Frame) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("read %d frames, wrote %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i].Data, want[i].Data) {
+			t.Errorf("frame %d: payload differs", i)
+		}
+		// the track has millisecond timestamps relative to the first frame
+		offset := want[i].Timestamp.Sub(want[0].Timestamp).Truncate(time.Millisecond)
+		if wantAt := want[0].Timestamp.Add(offset); !got[i].Timestamp.Equal(wantAt) {
+			t.Errorf("frame %d: timestamp %v, want %v", i, got[i].Timestamp, wantAt)
+		}
+	}
+}
+
+func TestMkvRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	frames := testFrames(100)
+	writeMkv(t, newMkvWriter(&out, 640, 480), frames)
+	compareFrames(t, readFrames(t, out.Bytes()), frames)
+}
+
+func TestMkvClampsBackwardTimestamps(t *testing.T) {
+	var out bytes.Buffer
+	frames := testFrames(3)
+	frames[2].Timestamp = frames[0].Timestamp.Add(-time.Second)
+	writeMkv(t, newMkvWriter(&out, 640, 480), frames)
+	got := readFrames(t, out.Bytes())
+	if len(got) != 3 || !got[2].Timestamp.Equal(got[1].Timestamp) {
+		t.Fatalf("got %d frames, last at %v, want it at %v", len(got), got[len(got)-1].Timestamp, got[1].Timestamp)
+	}
+}
+
+func TestMkvStreamingWritesEveryFrameAtOnce(t *testing.T) {
+	var out bytes.Buffer
+	w := newMkvWriter(&out, 640, 480)
+	w.streaming = true
+	frames := testFrames(10)
+	for i, frame := range frames {
+		if err := w.WriteFrame(frame.Data, frame.Timestamp); err != nil {
+			t.Fatal(err)
+		}
+		// readable before Close, nothing is held back for the cluster
+		compareFrames(t, readFrames(t, out.Bytes()), frames[:i+1])
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.cues) != 0 {
+		t.Fatalf("%d cues kept for a stream", len(w.cues))
+	}
+}
+
+func TestMkvCloseStreamKeepsUnknownSize(t *testing.T) {
+	var out bytes.Buffer
+	writeMkv(t, newMkvWriter(&out, 640, 480), testFrames(10))
+	_, segment, _ := mkvNext(t, skipElement(t, out.Bytes()))
+	if segment != nil {
+		t.Fatalf("segment of a stream has a size")
+	}
+}
+
+func TestMkvClosePatchesSeekableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.mkv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := testFrames(100)
+	writeMkv(t, newMkvWriter(file, 640, 480), frames)
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareFrames(t, readFrames(t, data), frames)
+
+	id, segment, rest := mkvNext(t, skipElement(t, data))
+	if id != mkvSegment || segment == nil {
+		t.Fatalf("segment size not patched")
+	}
+	if len(rest) != 0 {
+		t.Fatalf("segment size leaves %d bytes", len(rest))
+	}
+	children := mkvChildren(t, segment)
+
+	seek := mkvChildren(t, mkvChildren(t, children[mkvSeekHead][0])[mkvSeek][0])
+	if !bytes.Equal(seek[mkvSeekID][0], mkvID(mkvCues)) {
+		t.Fatalf("seek head points to %x, want the cues", seek[mkvSeekID][0])
+	}
+	cuesAt := readMkvUint(seek[mkvSeekPosition][0])
+	if id, _, _ := mkvNext(t, segment[cuesAt:]); id != mkvCues {
+		t.Fatalf("seek position %d holds element %x, want the cues", cuesAt, id)
+	}
+
+	info := mkvChildren(t, children[mkvInfo][0])
+	duration := math.Float64frombits(binary.BigEndian.Uint64(info[mkvDuration][0]))
+	offset := func(i int) int64 {
+		return frames[i].Timestamp.Sub(frames[0].Timestamp).Truncate(time.Millisecond).Milliseconds()
+	}
+	// the last frame lasts as long as the one before
+	last := len(frames) - 1
+	if want := float64(2*offset(last) - offset(last-1)); duration != want {
+		t.Fatalf("duration %v, want %v", duration, want)
+	}
+
+	cues := mkvChildren(t, children[mkvCues][0])[mkvCuePoint]
+	clusters := children[mkvCluster]
+	if len(cues) != len(clusters) || len(clusters) < 4 {
+		t.Fatalf("%d cues for %d clusters", len(cues), len(clusters))
+	}
+	for i, cue := range cues {
+		point := mkvChildren(t, cue)
+		positions := mkvChildren(t, point[mkvCueTrackPositions][0])
+		at := readMkvUint(positions[mkvCueClusterPosition][0])
+		id, cluster, _ := mkvNext(t, segment[at:])
+		if id != mkvCluster {
+			t.Fatalf("cue %d points to element %x, want a cluster", i, id)
+		}
+		timecode := readMkvUint(mkvChildren(t, cluster)[mkvTimecode][0])
+		if cueTime := readMkvUint(point[mkvCueTime][0]); cueTime != timecode {
+			t.Fatalf("cue %d at %dms, its cluster at %dms", i, cueTime, timecode)
+		}
+	}
+}
+
+// mkvNext splits off the first element, body is nil when its size is unknown
+func mkvNext(t *testing.T, data []byte) (uint32, []byte, []byte) {
+	t.Helper()
+	src := bytes.NewReader(data)
+	r := bufio.NewReader(src)
+	id, size, err := readMkvHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := len(data) - src.Len() - r.Buffered()
+	if size == mkvUnknownSize {
+		return id, nil, data[head:]
+	}
+	end := head + int(size)
+	if end > len(data) {
+		t.Fatalf("element %x of %d bytes overruns the data", id, size)
+	}
+	return id, data[head:end], data[end:]
+}
+
+func skipElement(t *testing.T, data []byte) []byte {
+	t.Helper()
+	_, _, rest := mkvNext(t, data)
+	return rest
+}
+
+// mkvChildren are the bodies of the child elements by id
+func mkvChildren(t *testing.T, data []byte) map[uint32][][]byte {
+	t.Helper()
+	children := make(map[uint32][][]byte)
+	for len(data) > 0 {
+		id, body, rest := mkvNext(t, data)
+		children[id] = append(children[id], body)
+		data = rest
+	}
+	return children
+}
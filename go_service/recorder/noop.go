@@ -0,0 +1,66 @@
+package recorder
+
+import (
+	"sync"
+	"time"
+)
+
+// NoopRecorder writes nothing, it only counts frames,
+// so sessions can run on machines without an encoder
+type NoopRecorder struct {
+	info    Info
+	started bool
+	done    chan struct{}
+	lock    sync.Mutex
+}
+
+func NewNoop() Recorder {
+	return &NoopRecorder{}
+}
+
+func (r *NoopRecorder) Start(basePath string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.started = true
+	r.done = make(chan struct{})
+	r.info = Info{
+		Backend:   BackendNoop,
+		Path:      basePath,
+		StartedAt: time.Now(),
+	}
+	return nil
+}
+
+func (r *NoopRecorder) WriteFrame(frame Frame) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.started {
+		return ErrNotStarted
+	}
+	r.info.addFrame(frame)
+	r.info.Bytes += int64(len(frame.Data))
+	return nil
+}
+
+func (r *NoopRecorder) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started {
+		r.started = false
+		r.info.StoppedAt = time.Now()
+		close(r.done)
+	}
+	return nil
+}
+
+func (r *NoopRecorder) Done() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.done
+}
+
+func (r *NoopRecorder) Info() Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.info
+}
@@ -0,0 +1,197 @@
+package recorder
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrProcessExited = errors.New("encoder process exited")
+
+// processRecorder feeds frames into stdin of an external encoder,
+// wrapped in a Matroska stream so every frame keeps its capture time
+type processRecorder struct {
+	backend   string
+	extension string
+	binary    string
+	args      func(path string) []string
+	output    func(stdout io.Reader) // reads stdout if the encoder streams there
+	live      bool                   // frames reach the encoder one by one, not in clusters
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	writer    *mkvWriter
+	done      chan struct{}
+	stopping  bool
+	exitErr   error
+	info      Info
+	lock      sync.Mutex
+}
+
+func (r *processRecorder) Start(basePath string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.cmd != nil {
+		return fmt.Errorf("%s recorder is already started", r.backend)
+	}
+	path := basePath + r.extension
+	cmd := exec.Command(r.binary, r.args(path)...)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdin pipe: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stderr pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", r.binary, err)
+	}
+	r.cmd = cmd
+	r.stdin = stdin
+	r.writer = nil
+	r.done = make(chan struct{})
+	r.stopping = false
+	r.exitErr = nil
+	r.info = Info{
+		Backend:   r.backend,
+		Path:      path,
+		StartedAt: time.Now(),
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"backend": r.backend,
+		"pid":     cmd.Process.Pid,
+		"path":    path,
+	})
+	var output sync.WaitGroup
+	output.Add(2)
+	if r.output != nil {
+		go readOutput(stdout, r.output, &output)
+	} else {
+		go logOutput(stdout, log, logrus.DebugLevel, &output)
+	}
+	go logOutput(stderr, log, logrus.WarnLevel, &output)
+	go r.wait(cmd, &output, r.done, log)
+
+	log.Info("Encoder pipeline started")
+	return nil
+}
+
+// wait reaps the child, an exit not requested by Stop truncates the recording
+func (r *processRecorder) wait(cmd *exec.Cmd, output *sync.WaitGroup, done chan struct{}, log *logrus.Entry) {
+	// Wait must not be called before the pipes are drained
+	output.Wait()
+	err := cmd.Wait()
+
+	r.lock.Lock()
+	r.exitErr = err
+	r.info.StoppedAt = time.Now()
+	if !r.stopping {
+		r.info.Truncated = true
+		log.WithError(err).Errorf("Encoder exited unexpectedly, recording truncated after %d frames", r.info.Frames)
+	}
+	r.lock.Unlock()
+	close(done)
+}
+
+func logOutput(pipe io.Reader, log *logrus.Entry, level logrus.Level, output *sync.WaitGroup) {
+	defer output.Done()
+	scanner := bufio.NewScanner(pipe)
+	for scanner.Scan() {
+		log.Log(level, scanner.Text())
+	}
+}
+
+// readOutput drains what the reader leaves so the encoder never blocks on stdout
+func readOutput(pipe io.Reader, fn func(stdout io.Reader), output *sync.WaitGroup) {
+	defer output.Done()
+	fn(pipe)
+	io.Copy(io.Discard, pipe)
+}
+
+func (r *processRecorder) WriteFrame(frame Frame) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.stdin == nil {
+		return ErrNotStarted
+	}
+	select {
+	case <-r.done:
+		return ErrProcessExited
+	default:
+	}
+	if r.writer == nil {
+		writer, err := newMkvWriterForFrame(r.stdin, frame.Data)
+		if err != nil {
+			return err
+		}
+		writer.streaming = r.live
+		r.writer = writer
+	}
+	before := r.writer.written
+	err := r.writer.WriteFrame(frame.Data, frame.Timestamp)
+	r.info.Bytes += r.writer.written - before
+	if err != nil {
+		return fmt.Errorf("failed to write frame to %s stdin: %w", r.backend, err)
+	}
+	r.info.addFrame(frame)
+	return nil
+}
+
+func (r *processRecorder) Stop() error {
+	r.lock.Lock()
+	if r.cmd == nil {
+		r.lock.Unlock()
+		return nil
+	}
+	r.stopping = true
+	stdin := r.stdin
+	writer := r.writer
+	done := r.done
+	r.lock.Unlock()
+
+	if writer != nil {
+		// flushes the last cluster, fails harmlessly if the encoder is gone
+		if err := writer.Close(); err != nil {
+			logrus.Warnf("Failed to flush %s stream: %v", r.backend, err)
+		}
+	}
+	// closing stdin sends EOS, the encoder finalizes the file and exits
+	stdin.Close()
+	<-done
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cmd = nil
+	r.stdin = nil
+	r.writer = nil
+	if r.exitErr != nil {
+		return fmt.Errorf("%s exited with error: %w", r.backend, r.exitErr)
+	}
+	logrus.Printf("%s finished [%s]", r.backend, r.info.Path)
+	return nil
+}
+
+func (r *processRecorder) Done() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.done
+}
+
+func (r *processRecorder) Info() Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.info
+}
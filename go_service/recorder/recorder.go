@@ -0,0 +1,84 @@
+package recorder
+
+import (
+	"errors"
+	"time"
+	"yolo-detector-service/bootstrap"
+	pb "yolo-detector-service/grpc/generated"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BackendGStreamer = "gstreamer"
+	BackendFfmpeg    = "ffmpeg"
+	BackendMjpeg     = "mjpeg"
+	BackendNoop      = "noop"
+	// not selectable by RECORDER_BACKEND, used by sessions in snapshot mode
+	BackendSnapshot = "snapshot"
+	// not selectable by RECORDER_BACKEND, the live view of a session
+	BackendHls = "hls"
+	// not selectable by RECORDER_BACKEND, the WebRTC view of a session
+	BackendVp8 = "vp8"
+)
+
+var ErrNotStarted = errors.New("recorder is not started")
+
+// Recorder turns a sequence of JPEG frames into a single recording
+type Recorder interface {
+	// Start opens a new recording, basePath has no extension,
+	// the backend appends the one of its container
+	Start(basePath string) error
+	WriteFrame(frame Frame) error
+	Stop() error
+	// Done is closed once the recording has ended, either by Stop
+	// or on its own, then Info().Truncated tells which one
+	Done() <-chan struct{}
+	Info() Info
+}
+
+// Frame is one JPEG with the time it was taken and what was detected on it
+type Frame struct {
+	Data      []byte
+	Timestamp time.Time
+	Events    []*pb.TrackEvent
+}
+
+type Info struct {
+	Backend   string
+	Path      string
+	StartedAt time.Time
+	StoppedAt time.Time
+	Frames    int
+	Bytes     int64
+	// capture times of the first and the last written frame
+	FirstFrameAt time.Time
+	LastFrameAt  time.Time
+	// the recording ended without Stop, e.g. the encoder crashed
+	Truncated bool
+}
+
+// New returns the recorder configured with RECORDER_BACKEND
+func New(env *bootstrap.Env) Recorder {
+	switch env.RECORDER_BACKEND {
+	case BackendFfmpeg:
+		return NewFfmpeg()
+	case BackendMjpeg:
+		return NewMjpeg()
+	case BackendNoop:
+		return NewNoop()
+	case BackendGStreamer, "":
+		return NewGStreamer()
+	default:
+		logrus.Warnf("Unknown recorder backend %q, using %s", env.RECORDER_BACKEND, BackendGStreamer)
+		return NewGStreamer()
+	}
+}
+
+func (i *Info) addFrame(frame Frame) {
+	if i.Frames == 0 {
+		i.FirstFrameAt = frame.Timestamp
+	}
+	i.LastFrameAt = frame.Timestamp
+	i.Frames += 1
+}
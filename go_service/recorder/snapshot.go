@@ -0,0 +1,75 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// SnapshotRecorder keeps a single still, the first frame it is given,
+// the session starts a new one every SNAPSHOT_INTERVAL
+type SnapshotRecorder struct {
+	info    Info
+	started bool
+	done    chan struct{}
+	lock    sync.Mutex
+}
+
+func NewSnapshot() Recorder {
+	return &SnapshotRecorder{}
+}
+
+func (r *SnapshotRecorder) Start(basePath string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.started = true
+	r.done = make(chan struct{})
+	r.info = Info{
+		Backend:   BackendSnapshot,
+		Path:      basePath + ".jpg",
+		StartedAt: time.Now(),
+	}
+	return nil
+}
+
+func (r *SnapshotRecorder) WriteFrame(frame Frame) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.started {
+		return ErrNotStarted
+	}
+	if r.info.Frames > 0 {
+		return nil
+	}
+	if err := os.WriteFile(r.info.Path, frame.Data, 0644); err != nil {
+		os.Remove(r.info.Path)
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	r.info.addFrame(frame)
+	r.info.Bytes = int64(len(frame.Data))
+	return nil
+}
+
+func (r *SnapshotRecorder) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started {
+		r.started = false
+		r.info.StoppedAt = time.Now()
+		close(r.done)
+	}
+	return nil
+}
+
+func (r *SnapshotRecorder) Done() <-chan struct{} {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.done
+}
+
+func (r *SnapshotRecorder) Info() Info {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.info
+}
@@ -0,0 +1,40 @@
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// NewVp8Stream encodes frames to VP8 with ffmpeg for real time viewers,
+// fn reads the IVF stream from stdout until the encoder exits. Every frame
+// in comes out as one IVF frame as soon as it is encoded, in order
+func NewVp8Stream(keyframeInterval time.Duration, fn func(stream io.Reader)) Recorder {
+	return &processRecorder{
+		backend: BackendVp8,
+		binary:  "ffmpeg",
+		args: func(path string) []string {
+			return vp8Args(keyframeInterval)
+		},
+		output: fn,
+		live:   true,
+	}
+}
+
+func vp8Args(keyframeInterval time.Duration) []string {
+	seconds := strconv.FormatFloat(keyframeInterval.Seconds(), 'f', -1, 64)
+	return []string{
+		"-hide_banner", "-loglevel", "warning",
+		"-f", "matroska", "-i", "pipe:0",
+		"-fps_mode", "passthrough",
+		// no lookahead, no frame is held back or dropped
+		"-c:v", "libvpx", "-deadline", "realtime", "-cpu-used", "8",
+		"-lag-in-frames", "0", "-error-resilient", "1", "-b:v", "2M",
+		"-pix_fmt", "yuv420p",
+		// viewers joining mid-stream wait at most this long for a picture
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%s)", seconds),
+		"-flush_packets", "1",
+		"-f", "ivf", "pipe:1",
+	}
+}
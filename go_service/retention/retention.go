@@ -0,0 +1,388 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/bootstrap"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultInterval = time.Minute
+
+// a sidecar without its video is a segment being finalized,
+// after this long it is left over from an interrupted deletion
+const orphanGrace = time.Hour
+
+// the sidecar mode of continuous recordings, as controller.ModeDvr
+const modeDvr = "dvr"
+
+// Manager deletes the oldest finalized recordings once
+// RETENTION_MAX_AGE, RETENTION_MAX_BYTES or a camera quota is exceeded,
+// DVR recordings and markers also once they leave DVR_RETENTION and
+// leftovers in RECORDINGS_TMP_DIR after RETENTION_TMP_MAX_AGE
+type Manager struct {
+	env      *bootstrap.Env
+	roots    []string
+	interval time.Duration
+	quotas   map[string]int64
+	// to read encrypted sidecars
+	key      *archive.Key
+	manifest *archive.Manifest
+	markers  *archive.MarkerIndex
+}
+
+// recording is a finalized segment with its companion files
+type recording struct {
+	sidecar string
+	files   []string
+	camera  string
+	mode    string
+	start   time.Time
+	end     time.Time
+	bytes   int64
+}
+
+func New(env *bootstrap.Env, key *archive.Key, manifest *archive.Manifest, markers *archive.MarkerIndex) *Manager {
+	m := &Manager{
+		env:      env,
+		key:      key,
+		manifest: manifest,
+		markers:  markers,
+		interval: env.RETENTION_INTERVAL,
+		quotas:   make(map[string]int64),
+	}
+	if m.interval <= 0 {
+		m.interval = defaultInterval
+	}
+	for _, dir := range []string{env.ARCHIVE_DIR, env.RECORDINGS_TMP_DIR} {
+		if dir != "" && !slices.Contains(m.roots, filepath.Clean(dir)) {
+			m.roots = append(m.roots, filepath.Clean(dir))
+		}
+	}
+	for _, item := range env.RETENTION_CAMERA_QUOTAS {
+		camera, value, ok := strings.Cut(item, ":")
+		size, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if !ok || err != nil {
+			logrus.Warnf("Retention quota %q is not camera:bytes", item)
+			continue
+		}
+		m.quotas[strings.TrimSpace(camera)] = size
+	}
+	return m
+}
+
+func (m *Manager) enabled() bool {
+	return m.env.RETENTION_MAX_AGE > 0 || m.env.RETENTION_MAX_BYTES > 0 ||
+		m.env.RETENTION_CAMERA_BYTES > 0 || len(m.quotas) > 0 || m.env.DVR_RETENTION > 0 ||
+		m.env.RETENTION_TMP_MAX_AGE > 0
+}
+
+// Run sweeps every RETENTION_INTERVAL until ctx is done
+func (m *Manager) Run(ctx context.Context) {
+	if !m.enabled() {
+		logrus.Info("Retention is disabled, recordings are kept forever")
+		return
+	}
+	logrus.Printf("Retention started, max age: %v, max bytes: %d, camera max bytes: %d, tmp max age: %v",
+		m.env.RETENTION_MAX_AGE, m.env.RETENTION_MAX_BYTES, m.env.RETENTION_CAMERA_BYTES, m.env.RETENTION_TMP_MAX_AGE)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.Sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep deletes recordings, oldest first, until all limits hold
+func (m *Manager) Sweep() {
+	recordings := m.scan()
+	m.sweepTmp(recordings)
+	slices.SortFunc(recordings, func(a, b *recording) int {
+		return a.start.Compare(b.start)
+	})
+
+	kept := recordings[:0]
+	if window := m.env.DVR_RETENTION; window > 0 {
+		cutoff := time.Now().Add(-window)
+		for _, rec := range recordings {
+			if rec.mode == modeDvr && rec.end.Before(cutoff) {
+				m.delete(rec, "dvr window")
+				continue
+			}
+			kept = append(kept, rec)
+		}
+		recordings = kept
+		if pruned, err := m.markers.Prune(cutoff); err != nil {
+			logrus.Errorf("Retention failed to prune the DVR index: %v", err)
+		} else if pruned > 0 {
+			logrus.Infof("Retention deleted %d days of DVR markers", pruned)
+		}
+	}
+
+	kept = recordings[:0]
+	if maxAge := m.env.RETENTION_MAX_AGE; maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		for _, rec := range recordings {
+			if rec.end.Before(cutoff) {
+				m.delete(rec, "max age")
+				continue
+			}
+			kept = append(kept, rec)
+		}
+		recordings = kept
+	}
+
+	perCamera := make(map[string]int64)
+	for _, rec := range recordings {
+		perCamera[rec.camera] += rec.bytes
+	}
+	kept = recordings[:0]
+	for _, rec := range recordings {
+		quota := m.quota(rec.camera)
+		if quota > 0 && perCamera[rec.camera] > quota {
+			perCamera[rec.camera] -= rec.bytes
+			m.delete(rec, "camera quota")
+			continue
+		}
+		kept = append(kept, rec)
+	}
+	recordings = kept
+
+	if maxBytes := m.env.RETENTION_MAX_BYTES; maxBytes > 0 {
+		var total int64
+		for _, rec := range recordings {
+			total += rec.bytes
+		}
+		for _, rec := range recordings {
+			if total <= maxBytes {
+				break
+			}
+			total -= rec.bytes
+			m.delete(rec, "max bytes")
+		}
+	}
+}
+
+// sweepTmp deletes what crashed sessions left in RECORDINGS_TMP_DIR, files
+// neither a recording nor the manifest lists that were not written to for
+// RETENTION_TMP_MAX_AGE. Sidecars are left to scan and hidden directories,
+// e.g. the manifest, to their owners
+func (m *Manager) sweepTmp(recordings []*recording) {
+	maxAge := m.env.RETENTION_TMP_MAX_AGE
+	if maxAge <= 0 || m.env.RECORDINGS_TMP_DIR == "" {
+		return
+	}
+	root := filepath.Clean(m.env.RECORDINGS_TMP_DIR)
+	listed, err := m.manifest.Live()
+	if err != nil {
+		// better nothing deleted than an archived file
+		logrus.Errorf("Retention failed to read the manifest, %s is not swept: %v", root, err)
+		return
+	}
+	for _, rec := range recordings {
+		for _, path := range rec.files {
+			listed[path] = true
+		}
+	}
+	cutoff := time.Now().Add(-maxAge)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := strings.TrimSuffix(d.Name(), archive.EncryptedExt)
+		if !d.Type().IsRegular() || listed[path] || filepath.Ext(name) == ".json" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logrus.Errorf("Retention failed to delete leftover %s: %v", path, err)
+			return nil
+		}
+		logrus.WithFields(logrus.Fields{
+			"modified": info.ModTime(),
+			"bytes":    info.Size(),
+		}).Infof("Retention deleted leftover [%s]", path)
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("Retention failed to scan %s: %v", root, err)
+	}
+}
+
+func (m *Manager) quota(camera string) int64 {
+	if quota, ok := m.quotas[camera]; ok {
+		return quota
+	}
+	return m.env.RETENTION_CAMERA_BYTES
+}
+
+// scan finds the finalized recordings, those with a sidecar next to the video
+func (m *Manager) scan() []*recording {
+	var recordings []*recording
+	for _, root := range m.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			name := strings.TrimSuffix(d.Name(), archive.EncryptedExt)
+			if d.IsDir() || filepath.Ext(name) != ".json" || strings.HasPrefix(name, ".") {
+				return nil
+			}
+			rec, err := m.readRecording(path)
+			if err != nil {
+				logrus.Warnf("Retention skips %s: %v", path, err)
+				return nil
+			}
+			if rec != nil {
+				recordings = append(recordings, rec)
+			}
+			return nil
+		})
+		if err != nil {
+			logrus.Errorf("Retention failed to scan %s: %v", root, err)
+		}
+	}
+	return recordings
+}
+
+func (m *Manager) readRecording(sidecarPath string) (*recording, error) {
+	sidecar, err := archive.ReadSidecar(sidecarPath, m.key)
+	if err != nil {
+		return nil, err
+	}
+	if sidecar.File == "" {
+		// not one of ours
+		return nil, nil
+	}
+	dir := filepath.Dir(sidecarPath)
+	video, err := os.Stat(filepath.Join(dir, sidecar.File))
+	if errors.Is(err, fs.ErrNotExist) {
+		m.removeOrphan(sidecarPath, sidecar.Camera)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored, err := os.Stat(sidecarPath)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recording{
+		sidecar: sidecarPath,
+		files:   []string{filepath.Join(dir, sidecar.File)},
+		camera:  sidecar.Camera,
+		mode:    sidecar.Mode,
+		start:   sidecar.StartedAt,
+		end:     sidecar.EndedAt,
+		bytes:   video.Size() + stored.Size(),
+	}
+	if rec.end.IsZero() {
+		rec.end = video.ModTime()
+	}
+	if rec.start.IsZero() {
+		rec.start = rec.end
+	}
+	companions := sidecar.Subtitles
+	if sidecar.Thumbnail != "" {
+		companions = append(companions, sidecar.Thumbnail)
+	}
+	for _, name := range companions {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil {
+			rec.files = append(rec.files, path)
+			rec.bytes += info.Size()
+		}
+	}
+	return rec, nil
+}
+
+// delete removes the video first and the sidecar last, so an interrupted
+// deletion leaves at most an orphaned sidecar that the next sweeps remove.
+// The manifest learns about the deletion afterwards, it is not waited for,
+// on a full disk noting it may well fail until the space is freed
+func (m *Manager) delete(rec *recording, reason string) {
+	paths := append(rec.files, rec.sidecar)
+	removed := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logrus.Errorf("Retention failed to delete %s: %v", path, err)
+			break
+		}
+		removed = append(removed, path)
+	}
+	m.noteRemoved(rec.camera, removed)
+	if len(removed) < len(paths) {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"camera": rec.camera,
+		"start":  rec.start,
+		"bytes":  rec.bytes,
+		"reason": reason,
+	}).Infof("Retention deleted recording [%s]", rec.files[0])
+	m.removeEmptyDirs(filepath.Dir(rec.sidecar))
+}
+
+func (m *Manager) removeOrphan(sidecarPath string, camera string) {
+	info, err := os.Stat(sidecarPath)
+	if err != nil || time.Since(info.ModTime()) < orphanGrace {
+		return
+	}
+	if err := os.Remove(sidecarPath); err != nil {
+		logrus.Errorf("Retention failed to delete orphaned sidecar %s: %v", sidecarPath, err)
+		return
+	}
+	m.noteRemoved(camera, []string{sidecarPath})
+	logrus.Infof("Retention deleted orphaned sidecar [%s]", sidecarPath)
+}
+
+// noteRemoved records deleted files in the manifest, when that fails
+// verify reports them missing, which they are
+func (m *Manager) noteRemoved(camera string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	if err := m.manifest.Remove(camera, paths); err != nil {
+		logrus.Errorf("Retention failed to note the deletion of %s in the manifest: %v", paths[0], err)
+	}
+}
+
+// removeEmptyDirs cleans up the date directories of the archive layout
+func (m *Manager) removeEmptyDirs(dir string) {
+	for !slices.Contains(m.roots, dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir || os.Remove(dir) != nil {
+			// not empty, or not below a root
+			return
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,229 @@
+package retention
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"yolo-detector-service/archive"
+	"yolo-detector-service/bootstrap"
+)
+
+// writeRecording finalizes a video of size bytes for camera that ended ago,
+// it returns the video and its bytes with the sidecar
+func writeRecording(t *testing.T, dir string, name string, camera string, ago time.Duration, size int) (string, int64) {
+	t.Helper()
+	path := filepath.Join(dir, camera, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	end := time.Now().Add(-ago)
+	sidecar, err := archive.WriteSidecar(path, &archive.Sidecar{
+		Camera:    camera,
+		StartedAt: end.Add(-time.Minute),
+		EndedAt:   end,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, int64(size) + info.Size()
+}
+
+// writeLeftover is a file no sidecar lists, last written ago
+func writeLeftover(t *testing.T, path string, ago time.Duration) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("leftover"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-ago)
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func exists(t *testing.T, path string) bool {
+	t.Helper()
+	_, err := os.Stat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+// checkKept fails for every path in want that was deleted, or kept if not in want
+func checkKept(t *testing.T, paths []string, want map[string]bool) {
+	t.Helper()
+	for _, path := range paths {
+		if kept := exists(t, path); kept != want[path] {
+			t.Errorf("%s kept %v, want %v", filepath.Base(path), kept, want[path])
+		}
+		sidecar := archive.SidecarPath(path)
+		if _, err := os.Stat(sidecar); err == nil && !want[path] {
+			t.Errorf("sidecar of deleted %s kept", filepath.Base(path))
+		}
+	}
+}
+
+func TestSweepMaxAge(t *testing.T) {
+	env := &bootstrap.Env{
+		ARCHIVE_DIR:       t.TempDir(),
+		RETENTION_MAX_AGE: 24 * time.Hour,
+	}
+	old, _ := writeRecording(t, env.ARCHIVE_DIR, "old.mkv", "front", 25*time.Hour, 10)
+	recent, _ := writeRecording(t, env.ARCHIVE_DIR, "recent.mkv", "front", time.Hour, 10)
+	other, _ := writeRecording(t, env.ARCHIVE_DIR, "other.mkv", "back", 48*time.Hour, 10)
+
+	New(env, nil, nil, nil).Sweep()
+
+	checkKept(t, []string{old, recent, other}, map[string]bool{recent: true})
+	if exists(t, filepath.Join(env.ARCHIVE_DIR, "back")) {
+		t.Error("empty camera directory kept")
+	}
+}
+
+func TestSweepBytesDeletesOldestFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		// limits over the recordings of 100 bytes each and their sidecars
+		maxBytes    func(sizes []int64) int64
+		cameraBytes func(sizes []int64) int64
+		quotas      func(sizes []int64) []string
+		// by position, oldest first, the last one is of another camera
+		want []bool
+	}{
+		{
+			name: "total bytes",
+			maxBytes: func(sizes []int64) int64 {
+				return sizes[2] + sizes[3]
+			},
+			want: []bool{false, false, true, true},
+		},
+		{
+			name: "camera bytes",
+			cameraBytes: func(sizes []int64) int64 {
+				return sizes[1] + sizes[2]
+			},
+			want: []bool{false, true, true, true},
+		},
+		{
+			name: "camera quota",
+			quotas: func(sizes []int64) []string {
+				return []string{"front:" + strconv.FormatInt(sizes[2], 10)}
+			},
+			want: []bool{false, false, true, true},
+		},
+		{
+			name: "limits not reached",
+			maxBytes: func(sizes []int64) int64 {
+				return sizes[0] + sizes[1] + sizes[2] + sizes[3]
+			},
+			want: []bool{true, true, true, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := &bootstrap.Env{ARCHIVE_DIR: t.TempDir()}
+			var paths []string
+			var sizes []int64
+			// named against their age, the sweep goes by the recording times
+			for i, ago := range []time.Duration{4 * time.Hour, 3 * time.Hour, 2 * time.Hour} {
+				path, size := writeRecording(t, env.ARCHIVE_DIR, "clip_"+strconv.Itoa(2-i)+".mkv", "front", ago, 100)
+				paths = append(paths, path)
+				sizes = append(sizes, size)
+			}
+			path, size := writeRecording(t, env.ARCHIVE_DIR, "clip.mkv", "back", time.Hour, 100)
+			paths = append(paths, path)
+			sizes = append(sizes, size)
+
+			if test.maxBytes != nil {
+				env.RETENTION_MAX_BYTES = test.maxBytes(sizes)
+			}
+			if test.cameraBytes != nil {
+				env.RETENTION_CAMERA_BYTES = test.cameraBytes(sizes)
+			}
+			if test.quotas != nil {
+				env.RETENTION_CAMERA_QUOTAS = test.quotas(sizes)
+			}
+			New(env, nil, nil, nil).Sweep()
+
+			want := make(map[string]bool)
+			for i, keep := range test.want {
+				want[paths[i]] = keep
+			}
+			checkKept(t, paths, want)
+		})
+	}
+}
+
+func TestSweepTmp(t *testing.T) {
+	const maxAge = time.Hour
+	env := &bootstrap.Env{
+		RECORDINGS_TMP_DIR:    t.TempDir(),
+		RETENTION_TMP_MAX_AGE: maxAge,
+	}
+	tmp := env.RECORDINGS_TMP_DIR
+	manifest := archive.NewManifest(env)
+
+	crashed := filepath.Join(tmp, "crashed.mkv")
+	writeLeftover(t, crashed, 2*maxAge)
+	// the segment being recorded, written to all the time
+	open := filepath.Join(tmp, "front", "open.mkv")
+	writeLeftover(t, open, time.Second)
+	// finalized into the tmp dir, there is no archive
+	finalized, _ := writeRecording(t, tmp, "finalized.mkv", "front", 2*maxAge, 10)
+	writeLeftover(t, finalized, 2*maxAge)
+	// in the manifest, its sidecar lost
+	listed := filepath.Join(tmp, "front", "listed.mkv")
+	writeLeftover(t, listed, 2*maxAge)
+	if err := manifest.Add("front", []string{listed}); err != nil {
+		t.Fatal(err)
+	}
+	// in the manifest once, deleted on purpose since
+	removed := filepath.Join(tmp, "front", "removed.mkv")
+	writeLeftover(t, removed, 2*maxAge)
+	if err := manifest.Add("front", []string{removed}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Remove("front", []string{removed}); err != nil {
+		t.Fatal(err)
+	}
+	// a sidecar being written before its video is moved in
+	sidecar := filepath.Join(tmp, "front", "pending.json")
+	writeLeftover(t, sidecar, 2*maxAge)
+	hidden := filepath.Join(tmp, ".cache", "old.bin")
+	writeLeftover(t, hidden, 2*maxAge)
+
+	New(env, nil, manifest, nil).Sweep()
+
+	for path, want := range map[string]bool{
+		crashed:   false,
+		open:      true,
+		finalized: true,
+		listed:    true,
+		removed:   false,
+		sidecar:   true,
+		hidden:    true,
+	} {
+		if kept := exists(t, path); kept != want {
+			t.Errorf("%s kept %v, want %v", filepath.Base(path), kept, want)
+		}
+	}
+	if report, err := manifest.Verify(""); err != nil {
+		t.Fatal(err)
+	} else if len(report.Problems) != 0 {
+		t.Errorf("manifest broken by the sweep: %+v", report.Problems)
+	}
+}